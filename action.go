@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// commandQueueLen bounds the number of actions waiting to run.
+const commandQueueLen = 32
+
+// command is a single queued action invocation.
+type command struct {
+	name      string
+	args, env []string
+	// gen is the stateGen of the state change that queued the
+	// command, or zero for actions not run on state changes.
+	gen uint64
+	// hook is set for --hook-dir executables, which are run
+	// directly even with --shell.
+	hook bool
+	// done, if set, is sent the command's exit code once it has
+	// run. It must have room to receive without blocking.
+	done chan<- int
+}
+
+// argv returns the program to run for c, and its arguments. With
+// --shell, the command is run by sh, which sees the arguments as $1
+// onwards.
+func (c command) argv() (string, []string) {
+	if !*shell || c.hook {
+		return c.name, c.args
+	}
+	return "/bin/sh", append([]string{"-c", c.name, "powermon"}, c.args...)
+}
+
+// enqueue schedules c to be run by the worker after any actions
+// already queued or, with p.inline, runs it at once.
+func (p *powermon) enqueue(c command) {
+	if p.inline {
+		if p.ctx.Err() != nil {
+			debugLog("shutting down; not running %s", c.name)
+			return
+		}
+		p.runAndRecord(c)
+		return
+	}
+	select {
+	case p.commands <- c:
+		return
+	default:
+	}
+	// A full queue is most likely behind a hung action. Rather than
+	// stop handling signals until it ends, make room by dropping the
+	// actions of changes that have since been superseded.
+	if p.pruneQueue() == 0 {
+		warnLog("action queue is full; waiting to queue %s", c.name)
+	}
+	select {
+	case p.commands <- c:
+	case <-p.ctx.Done():
+		debugLog("shutting down; not queueing %s", c.name)
+	}
+}
+
+// pruneQueue removes the commands of superseded state changes from the
+// queue, returning how many were removed.
+func (p *powermon) pruneQueue() int {
+	p.queueMu.Lock()
+	defer p.queueMu.Unlock()
+	var keep []command
+	dropped := 0
+	for len(p.commands) > 0 {
+		c := <-p.commands
+		if c.gen != 0 && c.gen < p.stateGen.Load() {
+			debugLog("state has changed again; not running %s", c.name)
+			dropped++
+			continue
+		}
+		keep = append(keep, c)
+	}
+	for _, c := range keep {
+		p.commands <- c
+	}
+	return dropped
+}
+
+// worker runs queued commands one at a time until the queue is closed.
+// Once p.ctx is cancelled, any command still running is killed and
+// those still queued are dropped.
+func (p *powermon) worker() {
+	defer close(p.workerDone)
+	for {
+		p.queueMu.Lock()
+		c, ok := <-p.commands
+		p.queueMu.Unlock()
+		if !ok {
+			return
+		}
+		if p.ctx.Err() != nil {
+			debugLog("shutting down; not running %s", c.name)
+			continue
+		}
+		// Changes queued up behind a slow action are coalesced:
+		// only the latest state's actions are run.
+		if c.gen != 0 && c.gen < p.stateGen.Load() {
+			debugLog("state has changed again; not running %s", c.name)
+			continue
+		}
+		p.runAndRecord(c)
+	}
+}
+
+// runAndRecord runs c, noting its exit code and, for state change
+// actions, telling the breaker how it went.
+func (p *powermon) runAndRecord(c command) {
+	code := p.runRetrying(c)
+	p.setLastExit(code)
+	// Actions killed by shutdown didn't fail by themselves.
+	if c.gen != 0 && p.ctx.Err() == nil {
+		p.breaker.record(c.name, code == 0, time.Now())
+	}
+	if c.done != nil {
+		c.done <- code
+	}
+}
+
+// errShuttingDown is returned to callers waiting on actions that won't
+// be run because we're shutting down.
+var errShuttingDown = errors.New("shutting down")
+
+// manualRun is run()'s reply to a request from runActionNow: the names
+// of the commands it queued, in order, and where their exit codes will
+// be sent.
+type manualRun struct {
+	names []string
+	done  <-chan int
+}
+
+// runActionNow runs the actions for the current state, as the worker
+// would on a state change, and waits for them to finish. It returns an
+// error naming any that failed. The commands are queued by run(), so
+// that nothing else writes to the queue.
+func (p *powermon) runActionNow() error {
+	reply := make(chan manualRun, 1)
+	select {
+	case p.actionReqs <- reply:
+	case <-p.ctx.Done():
+		return errShuttingDown
+	}
+	var run manualRun
+	select {
+	case run = <-reply:
+	case <-p.ctx.Done():
+		return errShuttingDown
+	}
+	if len(run.names) == 0 {
+		return fmt.Errorf("no action configured for %s", p.getState())
+	}
+
+	// The worker runs them in order, so results arrive in order.
+	var failed []string
+	for _, name := range run.names {
+		select {
+		case code := <-run.done:
+			if code != 0 {
+				failed = append(failed, fmt.Sprintf("%s exited with status %d", name, code))
+			}
+		case <-p.ctx.Done():
+			return errShuttingDown
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// maxRetryDelay bounds the growing delay between action retries.
+const maxRetryDelay = 5 * time.Minute
+
+// runRetrying runs c, retrying up to --action-retries times while it
+// fails, doubling the delay between attempts from --action-retry-delay.
+// Retries are abandoned on shutdown, or once a later state change
+// supersedes c. It returns the exit code of the last attempt.
+func (p *powermon) runRetrying(c command) int {
+	name, args := c.argv()
+	delay := *retryWait
+	for attempt := 1; ; attempt++ {
+		code := runCommand(p.ctx, name, args, c.env)
+		if code == 0 || p.ctx.Err() != nil {
+			return code
+		}
+		if attempt > *retries {
+			if *retries > 0 {
+				warnLog("giving up on %s after %d attempts; last exit status %d", c.name, attempt, code)
+			}
+			return code
+		}
+
+		maybeLog("%s failed with status %d; retrying in %v (attempt %d of %d)", c.name, code, delay, attempt+1, *retries+1)
+		select {
+		case <-time.After(delay):
+		case <-p.ctx.Done():
+			return code
+		}
+		if c.gen != 0 && c.gen < p.stateGen.Load() {
+			debugLog("state has changed again; not retrying %s", c.name)
+			return code
+		}
+		stats.actionRetries.Add(1)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// killDelay is how long an action's process group has to exit after
+// SIGTERM before it is sent SIGKILL.
+const killDelay = time.Second
+
+// killGroup sends SIGKILL to process group pgid at deadline, unless
+// it has all exited by then.
+func killGroup(pgid int, deadline time.Time) {
+	// Signal 0 only checks that the group still exists.
+	for time.Now().Before(deadline) && syscall.Kill(-pgid, 0) == nil {
+		time.Sleep(50 * time.Millisecond)
+	}
+	syscall.Kill(-pgid, syscall.SIGKILL)
+}
+
+// runCommand executes name with args, adding env to the inherited
+// environment. It honours --action-timeout and cancellation of ctx,
+// and logs any failure. It returns the command's exit code, which is -1
+// if it couldn't be run or was killed.
+func runCommand(ctx context.Context, name string, args, env []string) int {
+	if *dryRun {
+		quoted := []string{strconv.Quote(name)}
+		for _, a := range args {
+			quoted = append(quoted, strconv.Quote(a))
+		}
+		// Logged at warn so that it shows at the default level.
+		logf(levelWarn, logFields{"action": name, "args": args, "env": env}, "dry run: would run %s with environment %q", strings.Join(quoted, " "), env)
+		return 0
+	}
+
+	if *actionTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *actionTime)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Run the action in its own process group so that a timeout
+	// or shutdown stops anything it started too, not just the
+	// direct child. The group is asked to exit first, so that
+	// actions may clean up.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: runAs.cred}
+	var termAt time.Time
+	cmd.Cancel = func() error {
+		termAt = time.Now()
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	// Don't wait forever on an action ignoring SIGTERM, or on
+	// output pipes held open by stragglers.
+	cmd.WaitDelay = killDelay
+	cmd.Dir = *workDir
+	if len(env) > 0 || runAs.cred != nil {
+		cmd.Env = append(append(os.Environ(), runAs.env...), env...)
+	}
+
+	cmdline := strings.Join(append([]string{name}, args...), " ")
+	logf(levelDebug, logFields{"action": cmdline}, "running command: %s", cmdline)
+	stats.actionRuns.Add(1)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if ctx.Err() != nil && cmd.Process != nil {
+		killGroup(cmd.Process.Pid, termAt.Add(killDelay))
+	}
+	// Output is worth seeing by default only when something went
+	// wrong.
+	outLevel := levelInfo
+	if err != nil {
+		outLevel = levelWarn
+		stats.actionFailures.Add(1)
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			logf(levelWarn, logFields{"action": cmdline, "timeout": actionTime.String()}, "'%s' timed out after %v", cmdline, *actionTime)
+		case errors.Is(ctx.Err(), context.Canceled):
+			warnLog("'%s' killed by shutdown", cmdline)
+		}
+		logf(levelWarn, logFields{"action": cmdline, "error": err.Error()}, "error running '%s': %v", cmdline, err)
+	}
+	logOutput(outLevel, cmdline, "stdout", stdout.Bytes())
+	logOutput(outLevel, cmdline, "stderr", stderr.Bytes())
+	code := cmd.ProcessState.ExitCode()
+	maybeLogWith(logFields{"action": cmdline, "exit_code": code}, "'%s' exited with status %d", cmdline, code)
+	return code
+}
+
+// logOutput logs what the action cmdline wrote to stream, if anything,
+// prefixed with the stream's name.
+func logOutput(level logLevel, cmdline, stream string, out []byte) {
+	out = bytes.TrimRight(out, "\n")
+	if len(out) == 0 {
+		return
+	}
+	logf(level, logFields{"action": cmdline, "stream": stream, "output": string(out)}, "[%s] %s", stream, out)
+}
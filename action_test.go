@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowAction is a script that logs its first argument to $DIR/log,
+// noting if another copy of it is already running, then sleeps.
+const slowAction = `#!/bin/sh
+mkdir "$DIR/running" 2>/dev/null || echo overlap >>"$DIR/log"
+echo "$1" >>"$DIR/log"
+sleep 0.3
+rmdir "$DIR/running"
+`
+
+// waitForFile waits for the file at path to contain want.
+func waitForFile(t *testing.T, path, want string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if b, _ := os.ReadFile(path); strings.Contains(string(b), want) {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %q in %s", want, path)
+}
+
+func TestWorkerRunsLatestGenerationAlone(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "act")
+	if err := os.WriteFile(script, []byte(slowAction), 0755); err != nil {
+		t.Fatal(err)
+	}
+	env := []string{"DIR=" + dir}
+
+	p := &powermon{
+		ctx:        context.Background(),
+		commands:   make(chan command, commandQueueLen),
+		workerDone: make(chan struct{}),
+	}
+	go p.worker()
+
+	// Rapid changes arrive while the first change's action runs.
+	p.enqueue(command{name: script, args: []string{"gen1"}, env: env, gen: p.stateGen.Add(1)})
+	waitForFile(t, filepath.Join(dir, "log"), "gen1")
+	for _, name := range []string{"gen2", "gen3", "gen4"} {
+		gen := p.stateGen.Add(1)
+		// Each change may queue several commands.
+		p.enqueue(command{name: script, args: []string{name + "a"}, env: env, gen: gen})
+		p.enqueue(command{name: script, args: []string{name + "b"}, env: env, gen: gen})
+	}
+	// Commands not run on state changes are never skipped.
+	p.enqueue(command{name: script, args: []string{"manual"}, env: env})
+	close(p.commands)
+	<-p.workerDone
+
+	b, err := os.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Fields(string(b)), []string{"gen1", "gen4a", "gen4b", "manual"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+}
+
+// stubbornChild is a script that exits on SIGTERM, leaving behind a
+// child that ignores it, with its output elsewhere, and touches
+// $DIR/late half a second later. The child says it's ready once it
+// ignores SIGTERM.
+const stubbornChild = `#!/bin/sh
+trap 'exit 0' TERM
+sh -c 'trap "" TERM; echo ready >"$DIR/ready"; sleep 0.5; touch "$DIR/late"; sleep 30' >/dev/null 2>&1 &
+wait
+`
+
+func TestRunCommandGivesGroupTimeToExit(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "act")
+	if err := os.WriteFile(script, []byte(stubbornChild), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		waitForFile(t, filepath.Join(dir, "ready"), "ready")
+		cancel()
+	}()
+	start := time.Now()
+	runCommand(ctx, script, nil, []string{"DIR=" + dir})
+
+	// The child isn't killed as soon as its parent exits.
+	if _, err := os.Stat(filepath.Join(dir, "late")); err != nil {
+		t.Errorf("child was killed before it could finish: %v", err)
+	}
+	if d := time.Since(start); d > 3*killDelay {
+		t.Errorf("runCommand() took %v after SIGTERM", d)
+	}
+}
+
+func TestEnqueueDoesNotBlockBehindHungAction(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "act")
+	// The first run waits for $DIR/release.
+	hang := `#!/bin/sh
+echo "$1" >>"$DIR/log"
+while [ "$1" = gen1 ] && [ ! -e "$DIR/release" ]; do sleep 0.05; done
+`
+	if err := os.WriteFile(script, []byte(hang), 0755); err != nil {
+		t.Fatal(err)
+	}
+	env := []string{"DIR=" + dir}
+
+	p := &powermon{
+		ctx:        context.Background(),
+		commands:   make(chan command, commandQueueLen),
+		workerDone: make(chan struct{}),
+	}
+	go p.worker()
+	p.enqueue(command{name: script, args: []string{"gen1"}, env: env, gen: p.stateGen.Add(1)})
+	waitForFile(t, filepath.Join(dir, "log"), "gen1")
+
+	// Far more changes than the queue holds.
+	queued := make(chan struct{})
+	go func() {
+		defer close(queued)
+		for i := 2; i <= 3*commandQueueLen; i++ {
+			p.enqueue(command{name: script, args: []string{fmt.Sprintf("gen%d", i)}, env: env, gen: p.stateGen.Add(1)})
+		}
+	}()
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("enqueue blocked behind a hung action")
+	}
+
+	os.WriteFile(filepath.Join(dir, "release"), nil, 0644)
+	close(p.commands)
+	<-p.workerDone
+	b, err := os.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Fields(string(b)), []string{"gen1", fmt.Sprintf("gen%d", 3*commandQueueLen)}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	enumerateDevices = "EnumerateDevices"
+	deviceAdded      = "DeviceAdded"
+	deviceRemoved    = "DeviceRemoved"
+
+	deviceType                 = "Type"
+	deviceTypeLinePower uint32 = 1
+	deviceTypeBattery   uint32 = 2
+	capacity                   = "Capacity"
+)
+
+// battery is a snapshot of a single UPower battery device.
+type battery struct {
+	path               dbus.ObjectPath
+	percentage         float64
+	energy, energyFull float64
+	state              uint32
+}
+
+// trackBatteries reports whether individual batteries are of interest.
+func trackBatteries() bool {
+	return *perBattery || *aggregate
+}
+
+// isBattery reports whether the UPower device at path is a battery.
+func (u upowerService) isBattery(bus busConn, path dbus.ObjectPath) (bool, error) {
+	v, err := bus.Object(u.dest, path).GetProperty(u.device() + "." + deviceType)
+	if err != nil {
+		return false, err
+	}
+	t, ok := v.Value().(uint32)
+	return ok && t == deviceTypeBattery, nil
+}
+
+// enumerateBatteries returns the paths of all batteries UPower knows.
+func (u upowerService) enumerateBatteries(bus busConn) ([]dbus.ObjectPath, error) {
+	devices, err := u.enumerateDevices(bus)
+	if err != nil {
+		return nil, err
+	}
+
+	var bats []dbus.ObjectPath
+	for _, d := range devices {
+		ok, err := u.isBattery(bus, d)
+		if err != nil {
+			debugLog("couldn't get type of %s: %v", d, err)
+			continue
+		}
+		if ok {
+			bats = append(bats, d)
+		}
+	}
+	return bats, nil
+}
+
+// readBattery returns the current charge details of the battery at path.
+func (u upowerService) readBattery(bus busConn, path dbus.ObjectPath) (battery, error) {
+	b := battery{path: path}
+	props := map[string]interface{}{
+		percentage:   &b.percentage,
+		"Energy":     &b.energy,
+		"EnergyFull": &b.energyFull,
+		deviceState:  &b.state,
+	}
+	obj := bus.Object(u.dest, path)
+	for name, dst := range props {
+		v, err := obj.GetProperty(u.device() + "." + name)
+		if err != nil {
+			return b, err
+		}
+		if err := v.Store(dst); err != nil {
+			return b, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return b, nil
+}
+
+// readCapacity returns the health of the batteries, as a percentage of
+// their design capacity, averaged over those that report it. It is -1
+// if none do.
+func (u upowerService) readCapacity(bus busConn) float64 {
+	bats, err := u.enumerateBatteries(bus)
+	if err != nil {
+		debugLog("couldn't enumerate batteries: %v", err)
+		return -1
+	}
+	var sum float64
+	var n int
+	for _, path := range bats {
+		v, err := bus.Object(u.dest, path).GetProperty(u.device() + "." + capacity)
+		if err != nil {
+			debugLog("couldn't get capacity of %s: %v", path, err)
+			continue
+		}
+		if c, ok := v.Value().(float64); ok && c > 0 {
+			sum += c
+			n++
+		}
+	}
+	if n == 0 {
+		return -1
+	}
+	return sum / float64(n)
+}
+
+// refreshBatteries re-enumerates the batteries we track.
+func (p *powermon) refreshBatteries() {
+	bats, err := p.upower.enumerateBatteries(p.sysBus)
+	if err != nil {
+		warnLog("couldn't enumerate batteries: %v", err)
+		return
+	}
+	p.batteries = make(map[dbus.ObjectPath]bool)
+	for _, b := range bats {
+		p.batteries[b] = true
+	}
+	debugLog("tracking %d batteries", len(p.batteries))
+}
+
+// deviceChanged handles UPower's DeviceAdded and DeviceRemoved signals.
+func (p *powermon) deviceChanged(sig *dbus.Signal) {
+	var path dbus.ObjectPath
+	if err := dbus.Store(sig.Body, &path); err != nil {
+		debugLog("ignoring malformed %s: %v", sig.Name, err)
+		return
+	}
+
+	if sig.Name == p.upower.iface+"."+deviceRemoved {
+		if p.batteries[path] {
+			maybeLog("battery %s removed", path)
+			delete(p.batteries, path)
+		}
+		return
+	}
+
+	if ok, err := p.upower.isBattery(p.sysBus, path); err != nil {
+		debugLog("couldn't get type of %s: %v", path, err)
+	} else if ok {
+		maybeLog("battery %s added", path)
+		p.batteries[path] = true
+	}
+}
+
+// readBatteries returns a snapshot of each tracked battery, ordered by
+// path.
+func (p *powermon) readBatteries() []battery {
+	var bats []battery
+	for path := range p.batteries {
+		b, err := p.upower.readBattery(p.sysBus, path)
+		if err != nil {
+			warnLog("couldn't read battery %s: %v", path, err)
+			continue
+		}
+		bats = append(bats, b)
+	}
+	sort.Slice(bats, func(i, j int) bool { return bats[i].path < bats[j].path })
+	return bats
+}
+
+// batteryEnv summarises bats as environment variables for the action.
+// The combined percentage is weighted by each battery's capacity, as
+// UPower does for its display device.
+func batteryEnv(bats []battery) []string {
+	var energy, full, pctSum float64
+	charging := "0"
+	for _, b := range bats {
+		energy += b.energy
+		full += b.energyFull
+		pctSum += b.percentage
+		if b.state == deviceCharging {
+			charging = "1"
+		}
+	}
+
+	env := []string{
+		fmt.Sprintf("POWERMON_BATTERIES=%d", len(bats)),
+		"POWERMON_ANY_CHARGING=" + charging,
+	}
+	switch {
+	case full > 0:
+		env = append(env, fmt.Sprintf("POWERMON_COMBINED_PERCENTAGE=%.0f", 100*energy/full))
+	case len(bats) > 0:
+		env = append(env, fmt.Sprintf("POWERMON_COMBINED_PERCENTAGE=%.0f", pctSum/float64(len(bats))))
+	}
+	return env
+}
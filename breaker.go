@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker stops running state change actions that keep failing. Once
+// an action has failed threshold times in a row, it is skipped until
+// cooldown has passed, then given another chance. A nil breaker allows
+// everything.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	// mu guards actions, which is written by the worker as actions
+	// finish and read by run() as they are queued.
+	mu      sync.Mutex
+	actions map[string]*breakerState
+}
+
+// breakerState is what a breaker knows of one action.
+type breakerState struct {
+	failures int
+	// disabledUntil is when a disabled action may run again.
+	disabledUntil time.Time
+}
+
+// newBreaker returns a breaker for --failure-threshold and
+// --failure-cooldown, or nil if the threshold is zero.
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{threshold: threshold, cooldown: cooldown, actions: make(map[string]*breakerState)}
+}
+
+// allow reports whether action may run at now.
+func (b *breaker) allow(action string, now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.actions[action]
+	if !ok || st.disabledUntil.IsZero() {
+		return true
+	}
+	if now.Before(st.disabledUntil) {
+		return false
+	}
+	maybeLog("%s cooled down; trying it again", action)
+	st.disabledUntil = time.Time{}
+	return true
+}
+
+// record notes whether action succeeded at now, disabling it if it has
+// now failed too often in a row.
+func (b *breaker) record(action string, ok bool, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.actions[action]
+	if st == nil {
+		st = &breakerState{}
+		b.actions[action] = st
+	}
+	if ok {
+		st.failures = 0
+		return
+	}
+	if st.failures++; st.failures < b.threshold {
+		return
+	}
+	st.failures = 0
+	st.disabledUntil = now.Add(b.cooldown)
+	logf(levelWarn, logFields{"action": action, "cooldown": b.cooldown.String()}, "%s has failed %d times in a row; disabling it for %v", action, b.threshold, b.cooldown)
+}
+
+// filter returns those of cmds that b allows to run at now.
+func (b *breaker) filter(cmds []string, now time.Time) []string {
+	var out []string
+	for _, c := range cmds {
+		if b.allow(c, now) {
+			out = append(out, c)
+		} else {
+			debugLog("not running disabled action %s", c)
+		}
+	}
+	return out
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// busConn is the subset of a D-Bus connection that powermon uses. It
+// lets a fake bus stand in for the real ones.
+type busConn interface {
+	Object(dest string, path dbus.ObjectPath) dbus.BusObject
+	AddMatchSignal(options ...dbus.MatchOption) error
+	RemoveMatchSignal(options ...dbus.MatchOption) error
+	Signal(ch chan<- *dbus.Signal)
+	RemoveSignal(ch chan<- *dbus.Signal)
+	RequestName(name string, flags dbus.RequestNameFlags) (dbus.RequestNameReply, error)
+	Export(v interface{}, path dbus.ObjectPath, iface string) error
+	Emit(path dbus.ObjectPath, name string, values ...interface{}) error
+	Context() context.Context
+	Close() error
+}
+
+// dbusConn adapts a real D-Bus connection to busConn.
+type dbusConn struct {
+	*dbus.Conn
+}
+
+// connectSessionBus opens a new session bus connection.
+func connectSessionBus() (busConn, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, err
+	}
+	return dbusConn{conn}, nil
+}
+
+// dialSystemBus opens a new system bus connection, without any match
+// rules.
+func dialSystemBus() (busConn, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return dbusConn{conn}, nil
+}
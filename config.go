@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// config holds settings read from a config file. Keys are flag names,
+// so any flag may be set from the file. Settings are kept in file
+// order, so repeatable flags may be given more than once.
+type config struct {
+	path     string
+	settings []setting
+}
+
+type setting struct {
+	key, value string
+}
+
+// systemConfig is the config file used when the user has none.
+const systemConfig = "/etc/powermon.conf"
+
+// defaultConfigPath returns the config file used when --config isn't
+// passed: the user's own, if it exists, otherwise the system one.
+func defaultConfigPath() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		path := filepath.Join(dir, "powermon.conf")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return systemConfig
+}
+
+// loadConfig parses the file at path. Each non-blank line that isn't a
+// comment (starting with '#' or ';') must be of the form "key = value",
+// where key is a flag name. A "[section]" header is accepted, and
+// ignored, for INI compatibility. Values may optionally be quoted.
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &config{path: path}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		k = strings.TrimSpace(k)
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		if flag.Lookup(k) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown setting %q", path, n, k)
+		}
+		c.settings = append(c.settings, setting{k, v})
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return c, nil
+}
+
+// apply sets each flag in fs named in the config, except for those
+// also passed on the command line, which take precedence. Flags not
+// passed on the command line start from their defaults, so settings
+// removed from the file since it was last applied don't linger.
+func (c *config) apply(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err == nil && !flagPassed(f.Name) {
+			err = f.Value.Set(f.DefValue)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, kv := range c.settings {
+		k, v := kv.key, kv.value
+		if flagPassed(k) {
+			continue
+		}
+		// Value.Set, unlike flag.Set, doesn't mark the flag
+		// as passed, which flagPassed relies on.
+		if err := fs.Lookup(k).Value.Set(v); err != nil {
+			return fmt.Errorf("%s: invalid value %q for %s: %v", c.path, v, k, err)
+		}
+	}
+
+	return nil
+}
+
+// reloadable names the settings that a reload changes. The rest are
+// only read at startup.
+var reloadable = map[string]bool{
+	"action":             true,
+	"on-battery-action":  true,
+	"on-ac-action":       true,
+	"low-action":         true,
+	"low-threshold":      true,
+	"critical-action":    true,
+	"critical-threshold": true,
+	"full-action":        true,
+	"lid-action":         true,
+	"hook-dir":           true,
+	"logfile":            true,
+}
+
+// copyFlags returns a private copy of our flags, holding their current
+// values. A reload is worked out in such a copy, since other goroutines
+// read the live flags.
+func copyFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		var v flag.Value
+		if l, ok := f.Value.(*stringList); ok {
+			c := append(stringList(nil), *l...)
+			v = &c
+		} else {
+			// Every flag's value is a pointer, whose String
+			// can be Set back.
+			v = reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+			v.Set(f.Value.String())
+		}
+		fs.Var(v, f.Name, f.Usage)
+		fs.Lookup(f.Name).DefValue = f.DefValue
+	})
+	return fs
+}
+
+// flagValue returns the value of the named flag in fs, for the flag
+// package's own flag types.
+func flagValue(fs *flag.FlagSet, name string) interface{} {
+	return fs.Lookup(name).Value.(flag.Getter).Get()
+}
+
+// stringList is a flag.Value collecting each use of a repeatable flag.
+// Setting it to "" clears it, which is how it is reset to its default.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	if v == "" {
+		*l = nil
+		return nil
+	}
+	*l = append(*l, v)
+	return nil
+}
+
+// actionEnv names the environment variable that may give the action.
+const actionEnv = "POWERMON_ACTION"
+
+// applyEnvAction sets --action in fs from $POWERMON_ACTION, if set, in
+// place of any given in the config file but not over one passed on the
+// command line.
+func applyEnvAction(fs *flag.FlagSet) {
+	if v := os.Getenv(actionEnv); v != "" && !flagPassed("action") {
+		*fs.Lookup("action").Value.(*stringList) = stringList{v}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+const (
+	stateChangedSignal = pmon + ".StateChanged"
+	currentStateProp   = "CurrentState"
+
+	propertiesIface   = "org.freedesktop.DBus.Properties"
+	propertiesChanged = propertiesIface + ".PropertiesChanged"
+)
+
+// pmonObject is the object exported on the session bus at pmonPath,
+// allowing other programs to query the running daemon.
+type pmonObject struct {
+	p *powermon
+}
+
+// GetState returns the current power state as a string, as passed to
+// the action.
+func (o pmonObject) GetState() (string, *dbus.Error) {
+	return o.p.getState().String(), nil
+}
+
+// RunAction runs the actions for the current state again, as if it had
+// just been entered, returning an error if any of them fails.
+func (o pmonObject) RunAction() *dbus.Error {
+	if err := o.p.runActionNow(); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// pmonProperties implements org.freedesktop.DBus.Properties for
+// pmonObject. All of our properties are read-only and derived from the
+// live powermon state, so there's nothing to store here.
+type pmonProperties struct {
+	p *powermon
+}
+
+func (pp pmonProperties) all() map[string]dbus.Variant {
+	return map[string]dbus.Variant{
+		currentStateProp: dbus.MakeVariant(pp.p.getState().String()),
+	}
+}
+
+// Get implements org.freedesktop.DBus.Properties.Get.
+func (pp pmonProperties) Get(iface, name string) (dbus.Variant, *dbus.Error) {
+	if iface != pmon {
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("unknown interface %q", iface))
+	}
+	v, ok := pp.all()[name]
+	if !ok {
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("unknown property %q", name))
+	}
+	return v, nil
+}
+
+// GetAll implements org.freedesktop.DBus.Properties.GetAll.
+func (pp pmonProperties) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	if iface != pmon {
+		return nil, dbus.MakeFailedError(fmt.Errorf("unknown interface %q", iface))
+	}
+	return pp.all(), nil
+}
+
+// Set implements org.freedesktop.DBus.Properties.Set.
+func (pp pmonProperties) Set(iface, name string, v dbus.Variant) *dbus.Error {
+	return dbus.MakeFailedError(fmt.Errorf("property %q is read-only", name))
+}
+
+// introspection describes everything we export at pmonPath.
+func introspection(obj pmonObject) *introspect.Node {
+	return &introspect.Node{
+		Name: pmonPath,
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			{
+				Name:    propertiesIface,
+				Methods: introspect.Methods(pmonProperties{}),
+				Signals: []introspect.Signal{{
+					Name: "PropertiesChanged",
+					Args: []introspect.Arg{
+						{Name: "interface", Type: "s"},
+						{Name: "changed", Type: "a{sv}"},
+						{Name: "invalidated", Type: "as"},
+					},
+				}},
+			},
+			{
+				Name:    pmon,
+				Methods: introspect.Methods(obj),
+				Properties: []introspect.Property{
+					{Name: currentStateProp, Type: "s", Access: "read"},
+				},
+				Signals: []introspect.Signal{{
+					Name: "StateChanged",
+					Args: []introspect.Arg{
+						{Name: "state", Type: "s"},
+						{Name: "timestamp", Type: "x"},
+						{Name: "previous", Type: "s"},
+					},
+				}},
+			},
+		},
+	}
+}
+
+// export publishes our object, its properties and introspection data on
+// the session bus.
+func (p *powermon) export() error {
+	obj := pmonObject{p}
+	if err := p.sessBus.Export(obj, pmonPath, pmon); err != nil {
+		return fmt.Errorf("sessBus.Export(%q, %q): %v", pmonPath, pmon, err)
+	}
+	if err := p.sessBus.Export(pmonProperties{p}, pmonPath, propertiesIface); err != nil {
+		return fmt.Errorf("sessBus.Export(%q, %q): %v", pmonPath, propertiesIface, err)
+	}
+	node := introspect.NewIntrospectable(introspection(obj))
+	if err := p.sessBus.Export(node, pmonPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+		return fmt.Errorf("sessBus.Export(%q, introspectable): %v", pmonPath, err)
+	}
+	return nil
+}
+
+// emitStateChanged broadcasts a StateChanged signal on the session bus
+// carrying the new state, the Unix time of the transition and the
+// previous state, along with the corresponding PropertiesChanged.
+// Failures are logged rather than returned; a lost session bus
+// shouldn't stop us tracking power state.
+func (p *powermon) emitStateChanged(prev, ps powerState) {
+	if err := p.sessBus.Emit(pmonPath, stateChangedSignal, ps.String(), time.Now().Unix(), prev.String()); err != nil {
+		warnLog("couldn't emit %s: %v", stateChangedSignal, err)
+	}
+
+	changed := map[string]dbus.Variant{currentStateProp: dbus.MakeVariant(ps.String())}
+	if err := p.sessBus.Emit(pmonPath, propertiesChanged, pmon, changed, []string{}); err != nil {
+		warnLog("couldn't emit %s: %v", propertiesChanged, err)
+	}
+}
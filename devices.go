@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// deviceTypes names the values of the UPower device Type property, as
+// upower(1) does.
+var deviceTypes = []string{
+	"unknown", "line-power", "battery", "ups", "monitor", "mouse",
+	"keyboard", "pda", "phone", "media-player", "tablet", "computer",
+	"gaming-input", "pen", "touchpad", "modem", "network", "headset",
+	"speakers", "headphones", "video", "other-audio", "remote-control",
+	"printer", "scanner", "camera", "wearable", "toy", "bluetooth-generic",
+}
+
+// deviceStates names the values of the UPower device State property.
+var deviceStates = []string{
+	"unknown", "charging", "discharging", "empty", "fully-charged",
+	"pending-charge", "pending-discharge",
+}
+
+// stateName returns the name of the UPower device state ds.
+func stateName(ds uint32) string {
+	if int(ds) < len(deviceStates) {
+		return deviceStates[ds]
+	}
+	return fmt.Sprintf("state-%d", ds)
+}
+
+// typeName returns the name of the UPower device type t.
+func typeName(t uint32) string {
+	if int(t) < len(deviceTypes) {
+		return deviceTypes[t]
+	}
+	return fmt.Sprintf("type-%d", t)
+}
+
+// enumerateDevices returns the paths of all devices UPower knows,
+// which doesn't include the display device.
+func (u upowerService) enumerateDevices(bus busConn) ([]dbus.ObjectPath, error) {
+	var devices []dbus.ObjectPath
+	if err := bus.Object(u.dest, u.path).Call(u.iface+"."+enumerateDevices, 0).Store(&devices); err != nil {
+		return nil, fmt.Errorf("%s: %v", enumerateDevices, err)
+	}
+	return devices, nil
+}
+
+// listDevices prints the path, type, state and percentage of each
+// UPower device, starting with the display device, returning the
+// process exit code.
+func listDevices() int {
+	bus, err := dialSystemBus()
+	if err != nil {
+		reallyLog("system bus connect failed: %v", err)
+		return 1
+	}
+	defer bus.Close()
+
+	u := upowerFromFlags()
+	devices, err := u.enumerateDevices(bus)
+	if err != nil {
+		reallyLog("couldn't list devices: %v", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tTYPE\tSTATE\tPERCENTAGE\tDISPLAY")
+	for _, d := range append([]dbus.ObjectPath{u.displayDevice()}, devices...) {
+		obj := bus.Object(u.dest, d)
+		get := func(name string, dst interface{}) error {
+			v, err := obj.GetProperty(u.device() + "." + name)
+			if err != nil {
+				return err
+			}
+			return v.Store(dst)
+		}
+
+		typ, state, pct := "?", "?", "-"
+		var t, ds uint32
+		if err := get(deviceType, &t); err != nil {
+			debugLog("couldn't get type of %s: %v", d, err)
+		} else {
+			typ = typeName(t)
+		}
+		if err := get(deviceState, &ds); err != nil {
+			debugLog("couldn't get state of %s: %v", d, err)
+		} else {
+			state = stateName(ds)
+		}
+		// Mains supplies report a meaningless 0%.
+		var p float64
+		if t != deviceTypeLinePower {
+			if err := get(percentage, &p); err != nil {
+				debugLog("couldn't get percentage of %s: %v", d, err)
+			} else {
+				pct = fmt.Sprintf("%.0f%%", p)
+			}
+		}
+		display := "no"
+		if d == u.displayDevice() {
+			display = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d, typ, state, pct, display)
+	}
+	w.Flush()
+	return 0
+}
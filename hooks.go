@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// listHooks returns the executables in dir, in name order, following
+// the run-parts convention: dotfiles, directories and anything not
+// executable are skipped. It is read afresh on every state change so
+// that hooks may be added or removed while we run.
+func listHooks(dir string) []string {
+	// Hooks run in --workdir, so a relative dir would lead elsewhere.
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		warnLog("couldn't read hook dir: %v", err)
+		return nil
+	}
+
+	var hooks []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		// Stat rather than using e.Info() so that symlinks to
+		// executables count.
+		fi, err := os.Stat(path)
+		if err != nil {
+			debugLog("skipping hook %q: %v", path, err)
+			continue
+		}
+		if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+			debugLog("skipping non-executable hook %q", path)
+			continue
+		}
+		hooks = append(hooks, path)
+	}
+	sort.Strings(hooks)
+	return hooks
+}
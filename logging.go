@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/syslog"
+	"os"
+	"time"
+)
+
+// syslogFacilities maps --syslog values to facilities.
+var syslogFacilities = map[string]syslog.Priority{
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// syslogFlag is the value of --syslog. It may be passed alone, like a
+// boolean flag, to log to the user facility, or as --syslog=<facility>.
+type syslogFlag struct {
+	facility string
+}
+
+func (f *syslogFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.facility
+}
+
+func (f *syslogFlag) Set(v string) error {
+	switch v {
+	case "true":
+		v = "user"
+	case "false":
+		v = ""
+	}
+	if _, ok := syslogFacilities[v]; v != "" && !ok {
+		return fmt.Errorf("unknown syslog facility %q", v)
+	}
+	f.facility = v
+	return nil
+}
+
+func (f *syslogFlag) IsBoolFlag() bool {
+	return true
+}
+
+// syslogOut is the syslog connection, when --syslog is in use.
+var syslogOut *syslog.Writer
+
+// openSyslog directs all logging to syslog, under tag.
+func openSyslog(facility, tag string) error {
+	w, err := syslog.New(syslogFacilities[facility]|syslog.LOG_INFO, tag)
+	if err != nil {
+		return err
+	}
+	syslogOut = w
+	return nil
+}
+
+// logLevel is a message severity, and the value of --log-level, the
+// least severe level logged.
+type logLevel int
+
+const (
+	// levelOff is only a --log-level: nothing is logged at it.
+	levelOff logLevel = iota - 1
+	levelError
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+var levelNames = map[logLevel]string{
+	levelOff:   "off",
+	levelError: "error",
+	levelWarn:  "warn",
+	levelInfo:  "info",
+	levelDebug: "debug",
+}
+
+func (l *logLevel) String() string {
+	if l == nil {
+		return ""
+	}
+	return levelNames[*l]
+}
+
+func (l *logLevel) Set(v string) error {
+	for level, name := range levelNames {
+		if name == v {
+			*l = level
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q; use off, error, warn, info or debug", v)
+}
+
+// logEnabled reports whether messages at level should be logged.
+// --verbose is shorthand for --log-level=debug.
+func logEnabled(level logLevel) bool {
+	return level <= logAt || *verbose
+}
+
+// logIdentity is included in every message with --log-hostname, to
+// tell machines apart in aggregated logs. It is read once at startup.
+var logIdentity struct {
+	hostname string
+	// session is the login session we run in, if any.
+	session string
+}
+
+// readLogIdentity fills in logIdentity.
+func readLogIdentity() {
+	h, err := os.Hostname()
+	if err != nil {
+		warnLog("couldn't get hostname for logging: %v", err)
+		h = "unknown"
+	}
+	logIdentity.hostname = h
+	logIdentity.session = os.Getenv("XDG_SESSION_ID")
+}
+
+// identityPrefix returns the text log prefix for logIdentity, to go
+// before prog: e.g. "laptop3 " or "laptop3 session 2 ".
+func identityPrefix() string {
+	if logIdentity.hostname == "" {
+		return ""
+	}
+	if logIdentity.session != "" {
+		return logIdentity.hostname + " session " + logIdentity.session + " "
+	}
+	return logIdentity.hostname + " "
+}
+
+// logFields are structured values attached to a log message. They are
+// only rendered by --log-format=json.
+type logFields map[string]interface{}
+
+func maybeLog(fmt string, args ...interface{}) {
+	maybeLogWith(nil, fmt, args...)
+}
+
+func reallyLog(fmt string, args ...interface{}) {
+	logf(levelError, nil, fmt, args...)
+}
+
+// warnLog logs a problem that doesn't stop us working.
+func warnLog(fmt string, args ...interface{}) {
+	logf(levelWarn, nil, fmt, args...)
+}
+
+// debugLog logs detail only of interest when debugging.
+func debugLog(fmt string, args ...interface{}) {
+	logf(levelDebug, nil, fmt, args...)
+}
+
+// maybeLogWith is maybeLog with structured fields.
+func maybeLogWith(f logFields, fmt string, args ...interface{}) {
+	logf(levelInfo, f, fmt, args...)
+}
+
+// logf writes a message at level in the configured --log-format, if
+// --log-level allows.
+func logf(level logLevel, f logFields, format string, args ...interface{}) {
+	if !logEnabled(level) {
+		return
+	}
+	if *logFormat != "json" {
+		if syslogOut != nil {
+			writeSyslog(level, fmt.Sprintf(format, args...))
+			return
+		}
+		log.Printf(format, args...)
+		return
+	}
+
+	rec := map[string]interface{}{}
+	for k, v := range f {
+		rec[k] = v
+	}
+	rec["ts"] = time.Now().Format(time.RFC3339Nano)
+	rec["level"] = levelNames[level]
+	rec["msg"] = fmt.Sprintf(format, args...)
+	if logIdentity.hostname != "" {
+		rec["hostname"] = logIdentity.hostname
+	}
+	if logIdentity.session != "" {
+		rec["session"] = logIdentity.session
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf(format, args...)
+		return
+	}
+	if syslogOut != nil {
+		writeSyslog(level, string(b))
+		return
+	}
+	log.Writer().Write(append(b, '\n'))
+}
+
+// writeSyslog sends msg to syslog with a severity matching level.
+func writeSyslog(level logLevel, msg string) {
+	switch level {
+	case levelError:
+		syslogOut.Err(msg)
+	case levelWarn:
+		syslogOut.Warning(msg)
+	case levelInfo:
+		syslogOut.Info(msg)
+	default:
+		syslogOut.Debug(msg)
+	}
+}
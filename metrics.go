@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stats holds the counters exported by the metrics endpoint.
+var stats struct {
+	stateChanges   atomic.Uint64
+	actionRuns     atomic.Uint64
+	actionFailures atomic.Uint64
+	actionRetries  atomic.Uint64
+	// actionsThrottled counts state changes not acted upon because
+	// of --max-rate.
+	actionsThrottled atomic.Uint64
+
+	mu          sync.Mutex
+	transitions map[transition]uint64
+}
+
+// transition is a change from one power state to another.
+type transition struct {
+	from, to powerState
+}
+
+// countTransition records a change of state from from to to.
+func countTransition(from, to powerState) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.transitions == nil {
+		stats.transitions = make(map[transition]uint64)
+	}
+	stats.transitions[transition{from, to}]++
+}
+
+// transitionCounts returns the transitions seen so far, ordered by
+// state, with their counts.
+func transitionCounts() ([]transition, map[transition]uint64) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	counts := make(map[transition]uint64, len(stats.transitions))
+	var ts []transition
+	for t, n := range stats.transitions {
+		ts = append(ts, t)
+		counts[t] = n
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		if ts[i].from != ts[j].from {
+			return ts[i].from < ts[j].from
+		}
+		return ts[i].to < ts[j].to
+	})
+	return ts, counts
+}
+
+// metricsShutdownTimeout bounds how long we wait for in-flight scrapes
+// when shutting down.
+const metricsShutdownTimeout = 5 * time.Second
+
+// startMetrics serves Prometheus metrics on addr until stopMetrics is
+// called.
+func (p *powermon) startMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("metrics listen on %q failed: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", p.serveMetrics)
+	p.metricsSrv = &http.Server{Handler: mux}
+
+	go func() {
+		if err := p.metricsSrv.Serve(l); err != http.ErrServerClosed {
+			reallyLog("metrics server failed: %v", err)
+		}
+	}()
+
+	maybeLog("serving metrics on %s", l.Addr())
+	return nil
+}
+
+// stopMetrics shuts down the metrics server, if running.
+func (p *powermon) stopMetrics() {
+	if p.metricsSrv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+	defer cancel()
+	if err := p.metricsSrv.Shutdown(ctx); err != nil {
+		warnLog("metrics server shutdown: %v", err)
+	}
+}
+
+// serveMetrics writes our metrics in the Prometheus text format.
+func (p *powermon) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP powermon_state_changes_total Power state transitions seen.")
+	fmt.Fprintln(w, "# TYPE powermon_state_changes_total counter")
+	fmt.Fprintf(w, "powermon_state_changes_total %d\n", stats.stateChanges.Load())
+
+	fmt.Fprintln(w, "# HELP powermon_state_transitions_total Power state transitions seen, by state.")
+	fmt.Fprintln(w, "# TYPE powermon_state_transitions_total counter")
+	ts, counts := transitionCounts()
+	for _, t := range ts {
+		fmt.Fprintf(w, "powermon_state_transitions_total{from=%q,to=%q} %d\n", t.from, t.to, counts[t])
+	}
+
+	fmt.Fprintln(w, "# HELP powermon_action_runs_total Action commands executed.")
+	fmt.Fprintln(w, "# TYPE powermon_action_runs_total counter")
+	fmt.Fprintf(w, "powermon_action_runs_total %d\n", stats.actionRuns.Load())
+
+	fmt.Fprintln(w, "# HELP powermon_action_failures_total Action commands that failed.")
+	fmt.Fprintln(w, "# TYPE powermon_action_failures_total counter")
+	fmt.Fprintf(w, "powermon_action_failures_total %d\n", stats.actionFailures.Load())
+
+	fmt.Fprintln(w, "# HELP powermon_action_retries_total Failed action commands retried.")
+	fmt.Fprintln(w, "# TYPE powermon_action_retries_total counter")
+	fmt.Fprintf(w, "powermon_action_retries_total %d\n", stats.actionRetries.Load())
+
+	fmt.Fprintln(w, "# HELP powermon_actions_throttled_total State changes not acted upon because of --max-rate.")
+	fmt.Fprintln(w, "# TYPE powermon_actions_throttled_total counter")
+	fmt.Fprintf(w, "powermon_actions_throttled_total %d\n", stats.actionsThrottled.Load())
+
+	fmt.Fprintln(w, "# HELP powermon_state Current power state (0 UNKNOWN, 1 ON_BATTERY, 2 AC_POWER, 3 CHARGING, 4 DISCHARGING, 5 FULL).")
+	fmt.Fprintln(w, "# TYPE powermon_state gauge")
+	fmt.Fprintf(w, "powermon_state %d\n", p.getState())
+
+	onBattery := 0
+	if p.getState().simple() == ON_BATTERY {
+		onBattery = 1
+	}
+	fmt.Fprintln(w, "# HELP powermon_on_battery Whether we are running on battery.")
+	fmt.Fprintln(w, "# TYPE powermon_on_battery gauge")
+	fmt.Fprintf(w, "powermon_on_battery %d\n", onBattery)
+
+	// Without a battery there is no percentage to report.
+	if pct, ok := p.getPercentage(); ok {
+		fmt.Fprintln(w, "# HELP powermon_battery_percentage Battery charge level.")
+		fmt.Fprintln(w, "# TYPE powermon_battery_percentage gauge")
+		fmt.Fprintf(w, "powermon_battery_percentage %g\n", pct)
+	}
+}
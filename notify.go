@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	notifications     = "org.freedesktop.Notifications"
+	notificationsPath = "/org/freedesktop/Notifications"
+
+	// notifyTimeout bounds how long we wait on the notification
+	// daemon, so a wedged one can't hold up the main loop.
+	notifyTimeout = 5 * time.Second
+)
+
+// Notification urgency levels, as defined by the notification spec.
+const (
+	urgencyLow    byte = 0
+	urgencyNormal byte = 1
+)
+
+// notify pops up a desktop notification via the session bus, with the
+// named icon and urgency. Failure, typically because there's no
+// notification daemon, is only logged.
+func (p *powermon) notify(summary, body, icon string, urgency byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	hints := map[string]dbus.Variant{"urgency": dbus.MakeVariant(urgency)}
+	obj := p.sessBus.Object(notifications, notificationsPath)
+	call := obj.CallWithContext(ctx, notifications+".Notify", 0,
+		"powermon", // app_name
+		uint32(0),  // replaces_id
+		icon,       // app_icon
+		summary,    // summary
+		body,       // body
+		[]string{}, // actions
+		hints,      // hints
+		int32(-1),  // expire_timeout; server default
+	)
+	if call.Err != nil {
+		warnLog("couldn't send desktop notification: %v", call.Err)
+	}
+}
+
+// notifyState sends a desktop notification describing ps. Switching
+// to battery is more noteworthy than returning to AC.
+func (p *powermon) notifyState(ps powerState) {
+	var summary, icon string
+	urgency := urgencyNormal
+	switch ps.simple() {
+	case ON_BATTERY:
+		summary, icon = "On Battery", "battery"
+	case AC_POWER:
+		summary, icon = "On AC", "ac-adapter"
+		urgency = urgencyLow
+	default:
+		summary, icon = "Power State Unknown", "dialog-warning"
+	}
+
+	body := ""
+	if pct, ok := p.getPercentage(); ok {
+		body = fmt.Sprintf("Battery at %.0f%%", pct)
+	}
+	p.notify(summary, body, icon, urgency)
+}
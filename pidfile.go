@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// writePidfile records our PID in path. A pidfile naming a process
+// that no longer exists is replaced, but one naming a live process is
+// an error. The file is created exclusively, so that of two instances
+// starting together only one succeeds.
+func writePidfile(path string) error {
+	for tries := 0; ; tries++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return fmt.Errorf("couldn't write pidfile: %v", err)
+			}
+			return nil
+		}
+		if !errors.Is(err, fs.ErrExist) || tries > 0 {
+			return fmt.Errorf("pidfile %q: %v", path, err)
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("pidfile %q: %v", path, err)
+		}
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && pid != os.Getpid() && processExists(pid) {
+			return fmt.Errorf("pidfile %q names running process %d", path, pid)
+		}
+		maybeLog("replacing stale pidfile %q", path)
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("couldn't remove stale pidfile: %v", err)
+		}
+	}
+}
+
+// processExists reports whether a process with the given PID is
+// running, even if it belongs to someone else.
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// removePidfile removes the pidfile at path, if it is still ours.
+func removePidfile(path string) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		warnLog("couldn't read pidfile: %v", err)
+		return
+	}
+	if strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		warnLog("pidfile %q no longer names us; leaving it", path)
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		warnLog("couldn't remove pidfile: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWritePidfile(t *testing.T) {
+	tests := []struct {
+		desc string
+		// old is the pidfile's contents beforehand, if it
+		// exists.
+		old     *string
+		wantErr bool
+	}{{
+		desc: "new",
+	}, {
+		desc: "stale",
+		old:  ptr("0\n"),
+	}, {
+		desc: "garbage",
+		old:  ptr("not a pid\n"),
+	}, {
+		desc:    "running",
+		old:     ptr(fmt.Sprintf("%d\n", os.Getppid())),
+		wantErr: true,
+	}}
+
+	for _, tc := range tests {
+		path := filepath.Join(t.TempDir(), "pid")
+		if tc.old != nil {
+			if err := os.WriteFile(path, []byte(*tc.old), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := writePidfile(path)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: writePidfile() = %v, want error %t", tc.desc, err, tc.wantErr)
+			continue
+		}
+		b, _ := os.ReadFile(path)
+		want := strconv.Itoa(os.Getpid())
+		if tc.wantErr {
+			want = strings.TrimSpace(*tc.old)
+		}
+		if got := strings.TrimSpace(string(b)); got != want {
+			t.Errorf("%s: pidfile holds %q, want %q", tc.desc, got, want)
+		}
+	}
+}
+
+func ptr(s string) *string { return &s }
@@ -1,32 +1,128 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 )
 
 var (
-	actionCmd = flag.String("action", "", "Run this command when 'on battery' state changes")
-	logfile   = flag.String("logfile", "", "If set, log to this path instead of the default (os.Stderr) target")
-	verbose   = flag.Bool("verbose", false, "If true, output logging status updates. Be quiet when false.")
+	configFile = flag.String("config", defaultConfigPath(), "Read settings from this file. Command line flags override its values")
+	actionCmds stringList
+	batteryCmd = flag.String("on-battery-action", "", "Run this command when switching to battery power, instead of --action")
+	acCmd      = flag.String("on-ac-action", "", "Run this command when switching to AC power, instead of --action")
+	shell      = flag.Bool("shell", false, "If true, run actions with sh -c, passing the state as $1. Beware of injection through untrusted values")
+	workDir    = flag.String("workdir", "", "If set, run actions in this directory, against which relative action paths are resolved")
+	runAsUser  = flag.String("run-as-user", "", "If set, run actions as this user. Requires powermon to run as root")
+	runAsGroup = flag.String("run-as-group", "", "If set, run actions with this group rather than --run-as-user's primary group")
+	dryRun     = flag.Bool("dry-run", false, "If true, log the commands that would be run instead of running them")
+	actionTime = flag.Duration("action-timeout", 0, "If non-zero, kill the action command if it runs longer than this")
+	retries    = flag.Int("action-retries", 0, "Retry a failing action up to this many times")
+	retryWait  = flag.Duration("action-retry-delay", time.Second, "How long to wait before retrying a failed action, doubling with each retry")
+	lowLevel   = flag.Float64("low-threshold", 0, "If non-zero, run --low-action when the battery drops below this percentage")
+	lowCmd     = flag.String("low-action", "", "Run this command, passed the battery percentage, when the battery drops below --low-threshold")
+	critLevel  = flag.Float64("critical-threshold", 0, "If non-zero, run --critical-action when the battery drops below this percentage")
+	fullCmd    = flag.String("full-action", "", "Run this command, passed the battery percentage, when the battery becomes fully charged")
+	critCmd    = flag.String("critical-action", "", "Run this command, passed the battery percentage, when the battery drops below --critical-threshold or UPower reports it critical")
+	hookDir    = flag.String("hook-dir", "", "If set, also run every executable in this directory, in name order, on each state change")
+	lidCmd     = flag.String("lid-action", "", "Run this command, passed OPEN or CLOSED, when the lid is opened or closed")
+	noAction   = flag.Bool("no-action", false, "If true, run no state change action, only logging and reporting the state")
+	noInitial  = flag.Bool("no-initial-action", false, "If true, don't run the action for the power state at startup, only on later changes")
+	maxRate    = flag.Int("max-rate", 0, "If non-zero, run the state change action at most this many times a minute, skipping it when changes come faster")
+	failLimit  = flag.Int("failure-threshold", 0, "If non-zero, stop running a state change action for --failure-cooldown once it has failed this many times in a row")
+	coolDown   = flag.Duration("failure-cooldown", 10*time.Minute, "How long to stop running an action that has reached --failure-threshold")
+	debounce   = flag.Duration("debounce", 0, "If non-zero, only act on a state change once the state has been stable this long")
+	devicePath = flag.String("device", "", "If set, follow the state and percentage of this UPower device path, rather than the display device and OnBattery")
+	aggregate  = flag.Bool("aggregate-batteries", false, "If true, pass combined details of all batteries to the action")
+	perBattery = flag.Bool("per-battery", false, "If true, run the action once per battery, passed the device path. Implies --aggregate-batteries")
+	noBattery  = flag.String("no-battery", "ac-only", "What to do when there's no battery, as on a desktop: ac-only, to monitor AC power alone, or exit")
+	instance   = flag.String("instance-name", "", "If set, register on the session bus as org.bdwalton.Powermon.<name>, so that several instances may run")
+	noSessBus  = flag.Bool("no-session-bus", false, "If true, don't use the session bus: no D-Bus interface, StateChanged signal or notifications")
+	allowMulti = flag.Bool("allow-multiple", false, "If true, don't register a session bus name at all, allowing any number of instances")
+	statusSock = flag.String("status-socket", "", "If set, serve JSON status to anyone connecting to this Unix socket")
+	stateFile  = flag.String("state-file", "", "If set, keep the current state and battery percentage in this file, as KEY=VALUE lines")
+	pidFile    = flag.String("pidfile", "", "If set, write our PID to this file, refusing to start if it names a running process")
+	startWait  = flag.Duration("startup-timeout", 0, "If non-zero, wait up to this long at startup for UPower to appear on the system bus, failing if it doesn't")
+	backend    = flag.String("backend", "auto", "Where to read the power state: upower, sysfs, or auto to poll sysfs only when UPower isn't running")
+	pollEvery  = flag.Duration("poll-interval", 5*time.Second, "How often to re-read the power state when using the sysfs backend")
+	metrics    = flag.String("metrics-addr", "", "If set, serve Prometheus metrics at http://<addr>/metrics")
+	showVer    = flag.Bool("version", false, "If true, print the version and exit")
+	query      = flag.Bool("query", false, "If true, print the current power state and exit")
+	listDevs   = flag.Bool("list-devices", false, "If true, print UPower's devices, with their type and percentage, and exit")
+	stdinEvts  = flag.Bool("stdin-events", false, "If true, run the actions for power states read from stdin, one per line (battery, ac or unknown), instead of monitoring D-Bus, and exit at EOF")
+	once       = flag.Bool("once", false, "If true, run the action for the current power state and exit with its exit code")
+	argFormat  = flag.String("arg-format", "enum", "How to pass the state to the action: enum (e.g. ON_BATTERY), short (battery or ac) or bool (1 on battery, else 0)")
+	simple     = flag.Bool("simple-states", false, "If true, only report ON_BATTERY and AC_POWER, not CHARGING, DISCHARGING and FULL")
+	notifyFlag = flag.Bool("notify", false, "If true, show a desktop notification on each state change")
+	logFormat  = flag.String("log-format", "text", "Log output format: text or json")
+	syslogTo   syslogFlag
+	syslogTag  = flag.String("syslog-tag", "", "Tag syslog messages with this instead of the program name")
+	logfile    = flag.String("logfile", "", "If set, log to this path instead of the default (os.Stderr) target")
+	logHost    = flag.Bool("log-hostname", false, "If true, include our hostname and login session in every log message")
+	logTrunc   = flag.Bool("logfile-truncate", false, "If true, truncate --logfile at startup instead of appending to it")
+	verbose    = flag.Bool("verbose", false, "If true, log everything, as with --log-level=debug")
+	logAt      = levelWarn
 )
 
-func maybeLog(fmt string, args ...interface{}) {
-	if *verbose {
-		reallyLog(fmt, args...)
-	}
+// Hidden flags, left out of --help, for pointing powermon at something
+// other than the system's UPower or power supplies, such as fakes in
+// tests.
+var (
+	upowerDest  = flag.String("upower-dest", defaultUPowerDest, "The D-Bus name of the UPower service")
+	upowerPath  = flag.String("upower-path", defaultUPowerPath, "The D-Bus path of the UPower root object")
+	upowerIface = flag.String("upower-iface", defaultUPowerIface, "The D-Bus interface of the UPower root object")
+	sysfsRoot   = flag.String("sysfs-root", defaultSysfsRoot, "The directory holding the power supplies read by the sysfs backend")
+
+	hiddenFlags = map[string]bool{"upower-dest": true, "upower-path": true, "upower-iface": true, "sysfs-root": true}
+)
+
+func init() {
+	flag.Var(&actionCmds, "action", "Run this command when 'on battery' state changes. May be repeated to run several commands in order")
+	flag.Var(&logAt, "log-level", "Log messages at this level or more severe: off, error, warn, info or debug")
+	flag.Var(&syslogTo, "syslog", "If set, log to syslog instead of --logfile or os.Stderr. Pass --syslog=<facility> to use other than the user facility")
+	flag.Usage = usage
+}
+
+// usage prints the flag defaults as flag.PrintDefaults does, but
+// without the hidden flags.
+func usage() {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(flag.CommandLine.Output())
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	fmt.Fprintf(fs.Output(), "Usage of %s:\n", os.Args[0])
+	fs.PrintDefaults()
 }
 
-func reallyLog(fmt string, args ...interface{}) {
-	log.Printf(fmt, args...)
+// flagPassed reports whether the named flag was set on the command line.
+func flagPassed(name string) bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
 }
 
 const (
@@ -34,177 +130,1516 @@ const (
 	UNKNOWN = iota
 	ON_BATTERY
 	AC_POWER
+	// finer grained states, used unless --simple-states is set.
+	// DISCHARGING replaces ON_BATTERY, while CHARGING and FULL
+	// refine AC_POWER.
+	CHARGING
+	DISCHARGING
+	FULL
 )
 
 type powerState uint8
 
 var states = map[powerState]string{
-	UNKNOWN:    "UNKNOWN",
-	ON_BATTERY: "ON_BATTERY",
-	AC_POWER:   "AC_POWER",
+	UNKNOWN:     "UNKNOWN",
+	ON_BATTERY:  "ON_BATTERY",
+	AC_POWER:    "AC_POWER",
+	CHARGING:    "CHARGING",
+	DISCHARGING: "DISCHARGING",
+	FULL:        "FULL",
 }
 
 func (ps powerState) String() string {
 	return states[ps]
 }
 
+// simple maps ps onto the original UNKNOWN, ON_BATTERY and AC_POWER
+// states.
+func (ps powerState) simple() powerState {
+	switch ps {
+	case DISCHARGING:
+		return ON_BATTERY
+	case CHARGING, FULL:
+		return AC_POWER
+	}
+	return ps
+}
+
+// arg renders ps as the action's argument, according to --arg-format:
+// the state name, "battery" or "ac", or "1" when on battery and "0"
+// when not. Unknown states are "unknown" and "-1" in the latter two.
+func (ps powerState) arg() string {
+	switch *argFormat {
+	case "short":
+		switch ps.simple() {
+		case ON_BATTERY:
+			return "battery"
+		case AC_POWER:
+			return "ac"
+		}
+		return "unknown"
+	case "bool":
+		switch ps.simple() {
+		case ON_BATTERY:
+			return "1"
+		case AC_POWER:
+			return "0"
+		}
+		return "-1"
+	}
+	return ps.String()
+}
+
 // powermon represents the object that will monitor system power state
 // and trigger actions on change
 type powermon struct {
-	// An executable command that will be run, passed an argument
-	// of battery or ac to allow the command to act accordingly
-	action          string
-	sysBus, sessBus *dbus.Conn
-	state           powerState
-	quitCh          chan struct{}
+	// lowFired and criticalFired are only accessed from run() and
+	// record whether the low and critical battery actions have
+	// already run during the current descent.
+	lowFired, criticalFired bool
+	// fullFired likewise records that the full action has run since
+	// the battery last discharged.
+	fullFired bool
+	// devState is the last UPower State reported for the watched
+	// device. Like lowFired, it is only accessed from run().
+	devState uint32
+	// warningLevel is the watched device's last WarningLevel, also
+	// only accessed from run().
+	warningLevel uint32
+	// debounce delays acting on state changes until the state has
+	// been stable for --debounce. settleC fires when it has, and is
+	// nil when no change is pending. Both are only used by run().
+	debounce *time.Timer
+	settleC  <-chan time.Time
+	// started is set once stateChange has handled the initial
+	// state.
+	started bool
+	// limiter enforces --max-rate, if set. It is only used by
+	// run().
+	limiter *tokenBucket
+	// breaker enforces --failure-threshold, if set.
+	breaker *breaker
+	// upowerGone is set while UPower is off the bus, after having
+	// been on it. It is only used by run().
+	upowerGone bool
+	// lidClosed is the last lid state UPower reported. Like
+	// devState, it is only accessed from run().
+	lidClosed bool
+	// batteries is the set of UPower battery devices, tracked when
+	// trackBatteries() is true. It is only used by run().
+	batteries map[dbus.ObjectPath]bool
+
+	sysBus, sessBus busConn
+	// redial replaces a lost system bus connection. Like sysBus
+	// and sessBus, it can be swapped out for a fake.
+	redial func() (busConn, error)
+	upower upowerService
+	// source is where we read the power state from. Changes it
+	// finds itself, rather than by D-Bus signal, arrive on states.
+	source powerSource
+	states chan sourceState
+	// stopWatch stops the source's watch and waits for it to return.
+	stopWatch func()
+	// watchdogC ticks when run() should feed systemd's watchdog, if
+	// it's enabled.
+	watchdogC <-chan time.Time
+	// sigC delivers signals from sysBus, replaced along with it on
+	// reconnecting.
+	sigC chan *dbus.Signal
+	// actionReqs carries RunAction's requests to run(), which
+	// queues the commands and replies with what it queued.
+	actionReqs chan chan manualRun
+	// ctx is cancelled to ask run() to return, which it signals by
+	// closing runDone.
+	ctx          context.Context
+	cancel       context.CancelFunc
+	runDone      chan struct{}
+	shutdownOnce sync.Once
+	// commands are run, in order, by a single worker goroutine so
+	// that slow actions never hold up signal processing.
+	commands chan command
+	// queueMu is held by the worker while it takes a command, and
+	// by enqueue while it prunes the queue, so pruning never
+	// reorders what's left.
+	queueMu    sync.Mutex
+	workerDone chan struct{}
+	// inline is set when there's no worker, with --stdin-events,
+	// so commands are run as they are queued.
+	inline bool
+	// stateGen counts the state changes whose actions have been
+	// queued, so that the worker can skip those superseded.
+	stateGen atomic.Uint64
+	// disconnects counts system bus connection losses.
+	disconnects int
+	// metricsSrv serves --metrics-addr, if set.
+	metricsSrv *http.Server
+	// statusLn accepts connections on --status-socket, if set.
+	statusLn net.Listener
+	// pidfile is the --pidfile we wrote, if any.
+	pidfile string
+	// stateFile is the --state-file we keep up to date, if any,
+	// and stateFileContents what we last wrote to it. Both are
+	// only used by run(), and shutdown() once it has returned.
+	stateFile         string
+	stateFileContents string
+
+	// mu guards state and percentage, which are written by run()
+	// and read by the exported D-Bus methods, and actions, which
+	// may be replaced on reload.
+	mu      sync.RWMutex
+	actions actions
+	state   powerState
+	// prevState is the state when stateChange last ran, used to
+	// tell real transitions from repeated notifications.
+	prevState powerState
+	// percentage is the charge level of the watched device. It is
+	// only meaningful when hasPercentage is true.
+	percentage    float64
+	hasPercentage bool
+	// lastTransition is when the state last changed, after startup.
+	lastTransition time.Time
+	// lastExit is the exit code of the most recent action, valid
+	// once hasRun is true.
+	lastExit int
+	hasRun   bool
 }
 
 const (
-	pmon       = "org.bdwalton.Powermon"
-	upower     = "org.freedesktop.UPower"
-	upowerPath = "/org/freedesktop/UPower"
-	onBattery  = "OnBattery"
+	pmon     = "org.bdwalton.Powermon"
+	pmonPath = "/org/bdwalton/Powermon"
 )
 
-func newPowermon(action string) (*powermon, error) {
-	sessBus, err := dbus.ConnectSessionBus()
-	if err != nil {
-		return nil, fmt.Errorf("session bus connect failed: %v", err)
+// instanceBusName returns the session bus name claimed by the instance
+// with the given --instance-name: pmon itself when it is empty.
+func instanceBusName(instance string) string {
+	if instance == "" {
+		return pmon
 	}
+	return pmon + "." + instance
+}
 
-	// Ensure only a single copy is registered and running
-	r, err := sessBus.RequestName(pmon, dbus.NameFlagDoNotQueue)
-	if err != nil {
-		return nil, fmt.Errorf("sessBus.RequestName(%q, 0): %v:", pmon, err)
+// validInstanceName reports whether s may be appended to pmon to form
+// a bus name: it must be a single name element, of letters, digits,
+// '_' and '-', not starting with a digit.
+func validInstanceName(s string) bool {
+	if s == "" {
+		return false
 	}
-	if r != dbus.RequestNameReplyPrimaryOwner {
-		return nil, fmt.Errorf("sessBus.RequestName(%q, 0): not the primary owner.", pmon)
+	for i, r := range s {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r == '_', r == '-':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
 	}
+	return true
+}
 
-	sysBus, err := dbus.ConnectSystemBus()
-	if err != nil {
-		return nil, fmt.Errorf("system bus connect failed: %v", err)
+// actions holds the user supplied commands run in response to power
+// events.
+type actions struct {
+	// Executable commands that will be run in order, passed an
+	// argument of battery or ac to allow the command to act
+	// accordingly
+	action []string
+	// Optional commands specific to a single state. When set, they
+	// are run in preference to action for that state.
+	batteryAction, acAction string
+	// lowAction is run once when the battery drops below
+	// lowThreshold while on battery power, and criticalAction
+	// likewise for criticalThreshold.
+	lowAction         string
+	lowThreshold      float64
+	criticalAction    string
+	criticalThreshold float64
+	// fullAction is run once when the battery becomes fully
+	// charged.
+	fullAction string
+	// lidAction is run, passed "OPEN" or "CLOSED", whenever the
+	// lid is opened or closed.
+	lidAction string
+	// hookDir holds more executables, run in name order after the
+	// others on every state change.
+	hookDir string
+}
+
+// actionsFrom returns the actions configured by the flags in fs, which
+// is flag.CommandLine but for reloads, with environment variables
+// expanded. With --shell, expansion of the commands is left to the
+// shell.
+func actionsFrom(fs *flag.FlagSet) actions {
+	expand := os.ExpandEnv
+	if *shell {
+		expand = func(s string) string { return s }
+	}
+	str := func(name string) string {
+		return fs.Lookup(name).Value.String()
 	}
+	return actions{
+		action:        expandAll(*fs.Lookup("action").Value.(*stringList), expand),
+		batteryAction: expand(str("on-battery-action")),
+		acAction:      expand(str("on-ac-action")),
+		lowAction:     expand(str("low-action")),
+		lowThreshold:  flagValue(fs, "low-threshold").(float64),
 
-	obj := sysBus.Object(upower, upowerPath)
-	var state powerState = UNKNOWN
-	if ps, err := obj.GetProperty(upower + "." + onBattery); err != nil {
-		reallyLog("failed to get battery state: %v", err)
-	} else {
-		v := ps.Value().(bool)
-		switch v {
-		case true:
-			state = ON_BATTERY
-		default:
-			state = AC_POWER
+		criticalAction:    expand(str("critical-action")),
+		criticalThreshold: flagValue(fs, "critical-threshold").(float64),
+		fullAction:        expand(str("full-action")),
+		lidAction:         expand(str("lid-action")),
+		hookDir:           os.ExpandEnv(str("hook-dir")),
+	}
+}
+
+// validate checks that --workdir is a directory and that every
+// configured command can be run, looking up those without a slash in
+// $PATH. Shell command lines are only checked for syntax errors.
+func (a actions) validate() error {
+	if *workDir != "" {
+		if fi, err := os.Stat(*workDir); err != nil {
+			return fmt.Errorf("bad --workdir: %v", err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("bad --workdir: %s is not a directory", *workDir)
 		}
 	}
+	cmds := append([]string{a.batteryAction, a.acAction, a.lowAction, a.criticalAction, a.fullAction, a.lidAction}, a.action...)
+	for _, c := range cmds {
+		if c == "" {
+			continue
+		}
+		if *shell {
+			// Catch syntax errors now rather than on the
+			// first state change.
+			if out, err := exec.Command("/bin/sh", "-n", "-c", c).CombinedOutput(); err != nil {
+				return fmt.Errorf("bad action %q: %s", c, bytes.TrimSpace(out))
+			}
+			continue
+		}
+		// Actions run in --workdir, so that's where relative
+		// paths lead.
+		if *workDir != "" && strings.ContainsRune(c, '/') && !filepath.IsAbs(c) {
+			c = filepath.Join(*workDir, c)
+		}
+		if _, err := exec.LookPath(c); err != nil {
+			return fmt.Errorf("bad action: %v", err)
+		}
+	}
+	return nil
+}
+
+// empty reports whether no state change action is configured.
+func (a actions) empty() bool {
+	return len(a.action) == 0 && a.batteryAction == "" && a.acAction == "" && a.hookDir == ""
+}
+
+// checkNeeded returns an error if no state change action is configured
+// but one is needed, because nothing else makes use of the state, or if
+// one is configured despite --no-action.
+func (a actions) checkNeeded() error {
+	switch {
+	case *noAction && !a.empty():
+		return errors.New("--no-action can't be used with --action, --on-battery-action, --on-ac-action or --hook-dir")
+	case a.empty() && !*noAction && !a.otherUses():
+		return errors.New("no action to run on state change; pass --action='/some/command', or --no-action to only monitor")
+	}
+	return nil
+}
 
+// otherUses reports whether anything besides a state change action
+// acts upon or reports the power state.
+func (a actions) otherUses() bool {
+	return a.lowAction != "" || a.criticalAction != "" || a.fullAction != "" || a.lidAction != "" ||
+		*stateFile != "" || *metrics != "" || *statusSock != "" || *notifyFlag
+}
+
+// newPowermon sets up monitoring of UPower on sysBus, and registers
+// our service on sessBus, running the action for the current state.
+func newPowermon(acts actions, sysBus, sessBus busConn) (*powermon, error) {
+	if err := acts.validate(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	p := &powermon{
+		ctx:     ctx,
+		cancel:  cancel,
 		sysBus:  sysBus,
 		sessBus: sessBus,
-		state:   state,
-		action:  os.ExpandEnv(action),
-		quitCh:  make(chan struct{}),
+		redial:  dialSystemBus,
+		upower:  upowerFromFlags(),
+		runDone: make(chan struct{}),
+		states:  make(chan sourceState),
+		actions: acts,
+		pidfile: *pidFile,
+
+		stateFile:  *stateFile,
+		actionReqs: make(chan chan manualRun),
+
+		commands:   make(chan command, commandQueueLen),
+		workerDone: make(chan struct{}),
+	}
+
+	if *maxRate > 0 {
+		p.limiter = newTokenBucket(*maxRate)
+	}
+	p.breaker = newBreaker(*failLimit, *coolDown)
+
+	if *startWait > 0 && *backend != "sysfs" {
+		if err := p.upower.waitFor(sysBus, *startWait); err != nil {
+			return nil, err
+		}
+	}
+
+	p.source = chooseSource(&p.sysBus, p.upower)
+	if !p.onUPower() && trackBatteries() {
+		return nil, errors.New("--aggregate-batteries and --per-battery need the upower backend")
+	}
+
+	if err := p.refreshState(); err != nil {
+		reallyLog("failed to get battery state: %v", err)
+	}
+	if err := p.checkBattery(); err != nil {
+		return nil, err
+	}
+	// Being full at startup isn't becoming full.
+	p.fullFired = p.devState == deviceFullyCharged
+	p.refreshPercentage()
+	if trackBatteries() {
+		p.refreshBatteries()
+	}
+	if p.onUPower() {
+		if closed, err := p.upower.readLidClosed(sysBus); err != nil {
+			maybeLog("failed to get lid state: %v", err)
+		} else {
+			p.lidClosed = closed
+		}
+	}
+
+	go p.worker()
+
+	// Export our methods before claiming the name so that callers
+	// never see the name without the object behind it.
+	if sessBus == nil {
+		debugLog("no session bus; not exporting our interface")
+	} else if err := p.export(); err != nil {
+		return nil, err
+	}
+
+	// Ensure only a single copy is registered and running, unless
+	// asked not to.
+	switch {
+	case sessBus == nil:
+	case *allowMulti:
+		debugLog("--allow-multiple is set; not claiming a bus name")
+	default:
+		name := instanceBusName(*instance)
+		r, err := sessBus.RequestName(name, dbus.NameFlagDoNotQueue)
+		if err != nil {
+			return nil, fmt.Errorf("sessBus.RequestName(%q, 0): %v:", name, err)
+		}
+		if r != dbus.RequestNameReplyPrimaryOwner {
+			return nil, fmt.Errorf("sessBus.RequestName(%q, 0): not the primary owner.", name)
+		}
 	}
 
 	p.stateChange()
 
-	if err := p.sysBus.AddMatchSignal(dbus.WithMatchObjectPath(upowerPath), dbus.WithMatchInterface("org.freedesktop.DBus.Properties"), dbus.WithMatchSender(upower)); err != nil {
-		return nil, fmt.Errorf("couldn't setup signal listener: %v", err)
+	// Start buffering signals before asking for them, so none
+	// are lost before run() starts.
+	p.sigC = listen(p.sysBus)
+	if err := p.subscribe(p.sysBus); err != nil {
+		return nil, err
+	}
+	p.startWatch()
+
+	if *statusSock != "" {
+		if err := p.startStatus(*statusSock); err != nil {
+			return nil, err
+		}
+	}
+
+	// Written last, so that it isn't left behind by a failure above.
+	if p.pidfile != "" {
+		if err := writePidfile(p.pidfile); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		warnLog("couldn't notify systemd of readiness: %v", err)
 	}
 
 	return p, nil
 }
 
+// getState returns the current power state.
+func (p *powermon) getState() powerState {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.state
+}
+
+// setState records a new power state.
+func (p *powermon) setState(ps powerState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = ps
+}
+
+// takeTransition returns the state last acted upon and the current
+// state, recording that the current state is now being acted upon.
+func (p *powermon) takeTransition() (powerState, powerState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prev := p.prevState
+	p.prevState = p.state
+	return prev, p.state
+}
+
+// settled reports whether the current state is the one last acted upon.
+func (p *powermon) settled() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.prevState == p.state
+}
+
+// getPercentage returns the battery percentage and whether it is known.
+func (p *powermon) getPercentage() (float64, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.percentage, p.hasPercentage
+}
+
+// setPercentage records a new battery percentage.
+func (p *powermon) setPercentage(pct float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.percentage = pct
+	p.hasPercentage = true
+}
+
+// clearPercentage forgets the battery percentage.
+func (p *powermon) clearPercentage() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hasPercentage = false
+}
+
+// getActions returns the currently configured actions.
+func (p *powermon) getActions() actions {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.actions
+}
+
+// setActions replaces the configured actions.
+func (p *powermon) setActions(a actions) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.actions = a
+}
+
+// actionsFor returns the commands to run for the given state. Once
+// either per-state action is set, the generic action is ignored, so a
+// state without its own action runs nothing.
+func (a actions) actionsFor(ps powerState) []string {
+	if a.batteryAction == "" && a.acAction == "" {
+		return a.action
+	}
+	switch {
+	case ps.simple() == ON_BATTERY && a.batteryAction != "":
+		return []string{a.batteryAction}
+	case ps.simple() == AC_POWER && a.acAction != "":
+		return []string{a.acAction}
+	}
+	return nil
+}
+
+// expandAll returns cmds, each passed through expand.
+func expandAll(cmds []string, expand func(string) string) []string {
+	var out []string
+	for _, c := range cmds {
+		out = append(out, expand(c))
+	}
+	return out
+}
+
 func (p *powermon) stateChange() {
-	s := p.state.String()
+	prev, cur := p.takeTransition()
+	s := cur.String()
+
+	maybeLogWith(logFields{"state": s, "prev_state": prev.String(), "new_state": s}, "power state: %s", s)
+	if p.stateFile != "" {
+		p.refreshPercentage()
+		p.updateStateFile()
+	}
 
-	maybeLog("power state: %s", s)
+	// The initial state isn't a transition, so only announce
+	// changes after that.
+	if prev != cur && p.started {
+		stats.stateChanges.Add(1)
+		countTransition(prev, cur)
+		p.setLastTransition(time.Now())
+		// There's no session bus with --stdin-events or
+		// --no-session-bus.
+		if p.sessBus != nil {
+			p.emitStateChanged(prev, cur)
+			// Notifications only say which supply we're on.
+			if *notifyFlag && prev.simple() != cur.simple() {
+				p.notifyState(cur)
+			}
+		}
+	}
+	if !p.started && *noInitial {
+		maybeLog("not running action for initial state")
+		// If UPower wasn't up yet, the first state it gives us
+		// is still the initial one.
+		p.started = cur != UNKNOWN
+		return
+	}
+	p.started = true
+	// Supersede the actions of any earlier change still queued.
+	gen := p.stateGen.Add(1)
 
-	maybeLog("running command: %s %s", p.action, s)
-	if out, err := exec.Command(p.action, s).CombinedOutput(); err != nil {
-		maybeLog("error running '%s %s': %v", p.action, s, err)
-		maybeLog("error output: %s", out)
+	acts := p.getActions()
+	cmds := acts.actionsFor(cur)
+	var hooks []string
+	if acts.hookDir != "" {
+		hooks = listHooks(acts.hookDir)
+	}
+	if acts.empty() {
+		// Monitoring only.
+		return
+	}
+	if len(cmds) == 0 && len(hooks) == 0 {
+		maybeLog("no action configured for %s", s)
+		return
+	}
+	now := time.Now()
+	cmds, hooks = p.breaker.filter(cmds, now), p.breaker.filter(hooks, now)
+	if len(cmds) == 0 && len(hooks) == 0 {
+		warnLog("every action for %s is disabled after failing; not running any", s)
+		return
+	}
+	if p.limiter != nil && !p.limiter.allow(now) {
+		stats.actionsThrottled.Add(1)
+		logf(levelWarn, logFields{"state": s, "max_rate": *maxRate}, "power state changing more than %d times a minute; not running action for %s", *maxRate, s)
+		return
+	}
+
+	for _, c := range p.commandsFor(prev, cur, cmds, hooks, gen) {
+		p.enqueue(c)
+	}
+}
+
+// commandsFor returns the commands that run cmds and hooks on the
+// change from prev to cur, with their arguments and environment, as
+// part of state change gen.
+func (p *powermon) commandsFor(prev, cur powerState, cmds, hooks []string, gen uint64) []command {
+	// Scripts that predate the percentage argument can simply
+	// ignore it; it is "-1" when unknown.
+	p.refreshPercentage()
+	pctArg := "-1"
+	s := cur.String()
+	env := []string{
+		"POWERMON_STATE=" + s,
+		"POWERMON_SIMPLE_STATE=" + cur.simple().String(),
+		"POWERMON_PREV_STATE=" + prev.String(),
+		fmt.Sprintf("POWERMON_TIMESTAMP=%d", time.Now().Unix()),
+	}
+	if pct, ok := p.getPercentage(); ok {
+		pctArg = fmt.Sprintf("%.0f", pct)
+		env = append(env, "POWERMON_PERCENTAGE="+pctArg)
+		// Only UPower estimates times and knows battery health.
+		if p.onUPower() {
+			env = append(env, p.timeEnv(cur)...)
+			if cur.simple() == ON_BATTERY {
+				env = append(env, fmt.Sprintf("POWERMON_CAPACITY=%.0f", p.upower.readCapacity(p.sysBus)))
+			}
+		}
+	}
+
+	// Each command is run once, or once per battery.
+	argv := [][]string{{cur.arg(), pctArg}}
+	if trackBatteries() {
+		bats := p.readBatteries()
+		env = append(env, batteryEnv(bats)...)
+		// Batteries can all be removed after startup.
+		if *perBattery && len(bats) == 0 {
+			warnLog("--per-battery is set, but there are no batteries; running each action once")
+		} else if *perBattery {
+			argv = nil
+			for _, b := range bats {
+				argv = append(argv, []string{cur.arg(), fmt.Sprintf("%.0f", b.percentage), string(b.path)})
+			}
+		}
+	}
+
+	var out []command
+	add := func(names []string, hook bool) {
+		for _, n := range names {
+			for _, args := range argv {
+				out = append(out, command{name: n, args: args, env: env, gen: gen, hook: hook})
+			}
+		}
+	}
+	add(cmds, false)
+	add(hooks, true)
+	return out
+}
+
+// queueManual queues the actions for the current state on request,
+// bypassing --max-rate and --failure-threshold. It is only called from
+// run().
+func (p *powermon) queueManual() manualRun {
+	cur := p.getState()
+	acts := p.getActions()
+	var hooks []string
+	if acts.hookDir != "" {
+		hooks = listHooks(acts.hookDir)
+	}
+	maybeLog("running action for %s on request", cur)
+	cmds := p.commandsFor(cur, cur, acts.actionsFor(cur), hooks, 0)
+	done := make(chan int, len(cmds))
+	run := manualRun{done: done}
+	for _, c := range cmds {
+		c.done = done
+		run.names = append(run.names, c.name)
+		p.enqueue(c)
+	}
+	return run
+}
+
+// timeEnv returns the environment variable holding UPower's estimate
+// of the time until the battery is empty, or full, as appropriate for
+// ps. UPower only estimates in the direction the charge is heading.
+func (p *powermon) timeEnv(ps powerState) []string {
+	var name, prop string
+	switch {
+	case ps.simple() == ON_BATTERY:
+		name, prop = "POWERMON_TIME_TO_EMPTY", timeToEmpty
+	case p.devState == deviceCharging:
+		name, prop = "POWERMON_TIME_TO_FULL", timeToFull
+	default:
+		return nil
+	}
+	secs, err := p.upower.readTime(p.sysBus, prop)
+	if err != nil {
+		debugLog("couldn't get %s: %v", prop, err)
+	}
+	return []string{fmt.Sprintf("%s=%d", name, secs)}
+}
+
+// checkThresholds runs the low and critical battery actions as the
+// charge drops past their thresholds.
+func (p *powermon) checkThresholds() {
+	acts := p.getActions()
+	pct, ok := p.getPercentage()
+	onBattery := ok && p.getState().simple() == ON_BATTERY
+	p.checkThreshold("low", acts.lowAction, &p.lowFired, onBattery && pct < acts.lowThreshold)
+	// UPower's own judgement that the battery is critical counts
+	// as much as ours.
+	p.checkThreshold("critical", acts.criticalAction, &p.criticalFired,
+		onBattery && pct < acts.criticalThreshold || p.warningLevel >= warningCritical)
+	p.checkFull(acts.fullAction)
+}
+
+// checkFull runs action, passed the battery percentage, when the
+// battery becomes fully charged. Unlike the thresholds, it only re-arms
+// once the battery discharges, so one hovering just below full while
+// plugged in doesn't keep firing it.
+func (p *powermon) checkFull(action string) {
+	if action == "" {
+		return
+	}
+	if p.getState().simple() == ON_BATTERY {
+		if p.fullFired {
+			maybeLog("battery discharging; re-arming full action")
+		}
+		p.fullFired = false
+		return
+	}
+	if p.devState != deviceFullyCharged || p.fullFired {
+		return
+	}
+
+	p.fullFired = true
+	pctArg := "-1"
+	if pct, ok := p.getPercentage(); ok {
+		pctArg = fmt.Sprintf("%.0f", pct)
+	}
+	maybeLogWith(logFields{"percentage": pctArg}, "battery fully charged; running full action")
+	p.enqueue(command{name: action, args: []string{pctArg}})
+}
+
+// checkThreshold runs action, passed the battery percentage, when the
+// battery crosses into the named condition, recording that in fired.
+// It re-arms once the condition no longer holds.
+func (p *powermon) checkThreshold(name, action string, fired *bool, crossed bool) {
+	if action == "" {
+		return
+	}
+
+	if !crossed {
+		if *fired {
+			maybeLog("battery no longer %s; re-arming %s action", name, name)
+		}
+		*fired = false
+		return
+	}
+
+	if !*fired {
+		*fired = true
+		pctArg := "-1"
+		if pct, ok := p.getPercentage(); ok {
+			pctArg = fmt.Sprintf("%.0f", pct)
+		}
+		logf(levelWarn, logFields{"percentage": pctArg, "threshold": name, "warning_level": p.warningLevel}, "battery %s at %s%%; running %s action", name, pctArg, name)
+		p.enqueue(command{name: action, args: []string{pctArg}})
 	}
 }
 
 func (p *powermon) run() {
-	defer close(p.quitCh)
+	defer close(p.runDone)
 
-	c := make(chan *dbus.Signal, 10)
-	p.sysBus.Signal(c)
+	c := p.sigC
+
+	// The watchdog is fed from this loop, rather than independently,
+	// so that systemd notices if we stop processing signals.
+	if d := watchdogInterval(); d > 0 {
+		debugLog("feeding systemd watchdog every %v", d)
+		t := time.NewTicker(d)
+		defer t.Stop()
+		p.watchdogC = t.C
+	}
 
-	maybeLog("polling...")
+	debugLog("polling...")
 	for {
 		select {
-		case sig := <-c:
-			val := sig.Body[1].(map[string]dbus.Variant)
-			// we get lidclosed events too, so filter to
-			// ensure the current signal is interesting
-			if v, ok := val[onBattery]; ok {
-				switch v.String() {
-				case "true":
-					p.state = ON_BATTERY
-				case "false":
-					p.state = AC_POWER
-				default:
-					p.state = UNKNOWN
-				}
-				p.stateChange()
+		case sig, ok := <-c:
+			if ok {
+				p.handleSignal(sig)
+				continue
 			}
-		case <-p.quitCh:
+			// godbus closes signal channels when the
+			// connection goes away.
+			if !p.handleDisconnect() {
+				return
+			}
+			c = p.sigC
+		case <-p.sysBus.Context().Done():
+			// The connection's context is cancelled when it
+			// closes, even if our channel hasn't been.
+			if !p.handleDisconnect() {
+				return
+			}
+			c = p.sigC
+		case s := <-p.states:
+			p.sourceChanged(s)
+		case reply := <-p.actionReqs:
+			reply <- p.queueManual()
+		case <-p.watchdogC:
+			feedWatchdog()
+		case <-p.settleC:
+			p.settleC = nil
+			if p.settled() {
+				maybeLog("power state settled back to %s; nothing to do", p.getState())
+				continue
+			}
+			p.stateChange()
+		case <-p.ctx.Done():
 			maybeLog("shutting down main loop")
 			return
 		}
 	}
 }
 
+// changed is called from run() when UPower reports a new state. The
+// state is acted upon once it has been stable for --debounce; if it
+// reverts to the state last acted upon before then, the pending change
+// is cancelled.
+func (p *powermon) changed() {
+	if *debounce <= 0 {
+		p.stateChange()
+		return
+	}
+
+	if p.settled() {
+		if p.settleC != nil {
+			maybeLog("power state reverted to %s; cancelling pending change", p.getState())
+			p.stopDebounce()
+			p.settleC = nil
+		}
+		return
+	}
+
+	maybeLog("power state now %s; waiting %v for it to settle", p.getState(), *debounce)
+	if p.debounce == nil {
+		p.debounce = time.NewTimer(*debounce)
+	} else {
+		p.stopDebounce()
+		p.debounce.Reset(*debounce)
+	}
+	p.settleC = p.debounce.C
+}
+
+// stopDebounce stops the debounce timer, discarding any firing we
+// haven't seen so it can't cut a later wait short.
+func (p *powermon) stopDebounce() {
+	if !p.debounce.Stop() {
+		select {
+		case <-p.debounce.C:
+		default:
+		}
+	}
+}
+
+// handleDisconnect handles a lost system bus connection, returning
+// false if we were asked to quit before it could be restored.
+func (p *powermon) handleDisconnect() bool {
+	p.disconnects++
+	warnLog("lost system bus connection (%d so far)", p.disconnects)
+	if !p.reconnect() {
+		maybeLog("shutting down main loop")
+		return false
+	}
+	return true
+}
+
+// listen returns a channel delivering signals from bus.
+func listen(bus busConn) chan *dbus.Signal {
+	c := make(chan *dbus.Signal, 10)
+	bus.Signal(c)
+	return c
+}
+
+// handleSignal processes a single signal from UPower, logind or the bus
+// itself.
+func (p *powermon) handleSignal(sig *dbus.Signal) {
+	debugLog("signal %s from %s at %s: %v", sig.Name, sig.Sender, sig.Path, sig.Body)
+	switch sig.Name {
+	case prepareForSleep:
+		p.sleepChanged(sig)
+	case nameOwnerChanged:
+		p.ownerChanged(sig)
+	case p.upower.iface + "." + deviceAdded, p.upower.iface + "." + deviceRemoved:
+		if trackBatteries() {
+			p.deviceChanged(sig)
+		}
+	case propertiesChanged:
+		// Another backend's state isn't to be overwritten.
+		if p.onUPower() {
+			p.propertiesChanged(sig)
+		}
+	}
+}
+
+// startWatch has the source watch for changes until p.stopWatch is
+// called or we shut down.
+func (p *powermon) startWatch() {
+	ctx, cancel := context.WithCancel(p.ctx)
+	done := make(chan struct{})
+	src := p.source
+	go func() {
+		defer close(done)
+		src.watch(ctx, p.states)
+	}()
+	p.stopWatch = func() {
+		cancel()
+		<-done
+	}
+}
+
+// onUPower reports whether UPower is where we read the power state.
+func (p *powermon) onUPower() bool {
+	_, ok := p.source.(upowerSource)
+	return ok
+}
+
+// subscribe asks bus for the signals we handle, including UPower's
+// property changes only if it's our source.
+func (p *powermon) subscribe(bus busConn) error {
+	return p.upower.subscribe(bus, p.onUPower())
+}
+
+// lidChanged runs the lid action if the lid state has changed.
+func (p *powermon) lidChanged(closed bool) {
+	if closed == p.lidClosed {
+		return
+	}
+	p.lidClosed = closed
+
+	s := "OPEN"
+	if closed {
+		s = "CLOSED"
+	}
+	maybeLogWith(logFields{"lid": s}, "lid state: %s", s)
+
+	if a := p.getActions().lidAction; a != "" {
+		p.enqueue(command{name: a, args: []string{s}, env: []string{"POWERMON_LID=" + s}})
+	}
+}
+
+// sleepChanged handles logind's PrepareForSleep signal. We may miss
+// UPower changes while suspended, so resync on resume.
+func (p *powermon) sleepChanged(sig *dbus.Signal) {
+	var sleeping bool
+	if err := dbus.Store(sig.Body, &sleeping); err != nil {
+		debugLog("ignoring malformed %s: %v", sig.Name, err)
+		return
+	}
+	if sleeping {
+		maybeLog("system going to sleep")
+		return
+	}
+	maybeLog("system resumed; re-reading power state")
+	old := p.getState()
+	p.resync()
+	if ps := p.getState(); ps != old {
+		maybeLog("power state changed while asleep, from %s to %s", old, ps)
+	}
+}
+
+// propertiesChanged processes a PropertiesChanged signal from UPower's
+// root object or the device we watch. Signals not in the expected
+// shape, or from other objects, are ignored.
+func (p *powermon) propertiesChanged(sig *dbus.Signal) {
+	if len(sig.Body) < 2 {
+		debugLog("ignoring %s from %s with %d values", sig.Name, sig.Path, len(sig.Body))
+		return
+	}
+	iface, ok := sig.Body[0].(string)
+	if !ok {
+		debugLog("ignoring %s from %s with interface of type %T", sig.Name, sig.Path, sig.Body[0])
+		return
+	}
+	val, ok := sig.Body[1].(map[string]dbus.Variant)
+	if !ok {
+		debugLog("ignoring %s from %s with changes of type %T", sig.Name, sig.Path, sig.Body[1])
+		return
+	}
+
+	// Tell the objects apart by path, since UPower's devices all
+	// share one interface.
+	switch {
+	case sig.Path == p.upower.path && iface == p.upower.iface:
+		p.upowerChanged(val)
+	case sig.Path == p.upower.watched() && iface == p.upower.device():
+		p.displayChanged(val)
+	default:
+		debugLog("ignoring %s from %s for %s", sig.Name, sig.Path, iface)
+		return
+	}
+	p.checkThresholds()
+	p.updateStateFile()
+}
+
+// upowerChanged handles changes to the properties of UPower itself.
+func (p *powermon) upowerChanged(val map[string]dbus.Variant) {
+	// we get lidclosed events too, which have their own handler
+	if v, ok := val[lidIsClosed]; ok {
+		if closed, ok := v.Value().(bool); ok {
+			p.lidChanged(closed)
+		} else {
+			mistyped(lidIsClosed, v)
+		}
+	}
+	// A --device's own State decides whether it's discharging.
+	if v, ok := val[onBattery]; ok && p.upower.dev == "" {
+		if b, ok := v.Value().(bool); ok {
+			var src powerState = AC_POWER
+			if b {
+				src = ON_BATTERY
+			}
+			// The device's State changes with OnBattery, but
+			// its signal may not have arrived yet; reading it
+			// now reports plugging in as one change, not two.
+			if ds, err := p.upower.readDeviceState(p.sysBus); err != nil {
+				debugLog("couldn't re-read %s: %v", deviceState, err)
+			} else {
+				p.devState = ds
+			}
+			p.setState(deriveState(src, p.devState))
+			p.changed()
+		} else {
+			mistyped(onBattery, v)
+		}
+	}
+}
+
+// displayChanged handles changes to the properties of the watched
+// device: the display device, or --device.
+func (p *powermon) displayChanged(val map[string]dbus.Variant) {
+	if v, ok := val[deviceState]; ok {
+		if ds, ok := v.Value().(uint32); ok {
+			p.devState = ds
+			// Charging and full are refinements of AC power,
+			// so only act if they change what we'd report.
+			old := p.getState()
+			if ns := p.upower.stateFor(old.simple(), ds); ns != old {
+				p.setState(ns)
+				p.changed()
+			}
+		} else {
+			mistyped(deviceState, v)
+		}
+	}
+	if v, ok := val[percentage]; ok {
+		if pct, ok := v.Value().(float64); ok {
+			debugLog("battery percentage: %.0f", pct)
+			p.setPercentage(pct)
+		} else {
+			mistyped(percentage, v)
+		}
+	}
+	if v, ok := val[warningLevel]; ok {
+		if wl, ok := v.Value().(uint32); ok {
+			debugLog("battery warning level: %d", wl)
+			p.warningLevel = wl
+		} else {
+			mistyped(warningLevel, v)
+		}
+	}
+}
+
+// mistyped notes a changed property whose value isn't of the type
+// UPower documents, which we ignore.
+func mistyped(name string, v dbus.Variant) {
+	debugLog("ignoring %s of unexpected type %s", name, v.Signature())
+}
+
+// shutdownTimeout bounds how long shutdown waits for run() and any
+// running action to stop.
+const shutdownTimeout = 5 * time.Second
+
+// shutdown stops run() and tears everything down, killing any running
+// action. If that takes longer than shutdownTimeout, it gives up
+// waiting. It may safely be called more than once, or concurrently;
+// later calls wait for the first to finish.
 func (p *powermon) shutdown() {
-	p.quitCh <- struct{}{}
-	<-p.quitCh
-	p.sysBus.Close()
-	p.sessBus.Close()
+	p.shutdownOnce.Do(func() {
+		if err := sdNotify("STOPPING=1"); err != nil {
+			warnLog("couldn't notify systemd of shutdown: %v", err)
+		}
+		p.cancel()
+
+		timeout := time.NewTimer(shutdownTimeout)
+		defer timeout.Stop()
+		clean := false
+		select {
+		case <-p.runDone:
+			// run() has returned, so nothing else will be
+			// queued.
+			close(p.commands)
+			select {
+			case <-p.workerDone:
+				clean = true
+			case <-timeout.C:
+			}
+		case <-timeout.C:
+		}
+		if clean {
+			maybeLog("shutdown was clean")
+		} else {
+			warnLog("shutdown timed out after %v; forcing it", shutdownTimeout)
+		}
+
+		p.stopMetrics()
+		p.stopStatus()
+		p.sysBus.Close()
+		if p.sessBus != nil {
+			p.sessBus.Close()
+		}
+		if clean {
+			// Otherwise run() may yet write it again.
+			p.removeStateFile()
+		}
+		if p.pidfile != "" {
+			removePidfile(p.pidfile)
+		}
+	})
+}
+
+// readConfig loads the config file, if any, and applies it to the
+// flags in set, then $POWERMON_ACTION. The default config file may be
+// absent.
+func readConfig(set *flag.FlagSet) error {
+	cfg, err := loadConfig(*configFile)
+	switch {
+	case err == nil:
+		err = cfg.apply(set)
+	case errors.Is(err, fs.ErrNotExist) && !flagPassed("config"):
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	applyEnvAction(set)
+	return nil
+}
+
+// loadSettings works out the flags a reload would give, in a copy of
+// the live ones, and checks them.
+func loadSettings() (*flag.FlagSet, error) {
+	fs := copyFlags()
+	if err := readConfig(fs); err != nil {
+		return nil, err
+	}
+	if err := checkFlags(fs); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// checkFlags returns an error describing the first invalid or
+// conflicting setting in fs.
+func checkFlags(fs *flag.FlagSet) error {
+	str := func(name string) string {
+		return fs.Lookup(name).Value.String()
+	}
+	num := func(name string) int {
+		return flagValue(fs, name).(int)
+	}
+	on := func(name string) bool {
+		return flagValue(fs, name).(bool)
+	}
+
+	switch f := str("log-format"); {
+	case f != "text" && f != "json":
+		return fmt.Errorf("unknown --log-format %q; use text or json", f)
+	}
+	switch f := str("arg-format"); {
+	case f != "enum" && f != "short" && f != "bool":
+		return fmt.Errorf("unknown --arg-format %q; use enum, short or bool", f)
+	}
+	switch b := str("backend"); {
+	case b != "auto" && b != "upower" && b != "sysfs":
+		return fmt.Errorf("unknown --backend %q; use auto, upower or sysfs", b)
+	}
+	if d := str("device"); d != "" && !dbus.ObjectPath(d).IsValid() {
+		return fmt.Errorf("--device %q isn't a valid D-Bus object path", d)
+	}
+	switch nb := str("no-battery"); {
+	case nb != "ac-only" && nb != "exit":
+		return fmt.Errorf("unknown --no-battery %q; use ac-only or exit", nb)
+	}
+	if name := str("instance-name"); name != "" && !validInstanceName(name) {
+		return fmt.Errorf("--instance-name %q must be letters, digits, '_' and '-', not starting with a digit", name)
+	}
+	if num("action-retries") < 0 {
+		return errors.New("--action-retries can't be negative")
+	}
+	if num("max-rate") < 0 {
+		return errors.New("--max-rate can't be negative")
+	}
+	if on("no-session-bus") && (on("notify") || str("instance-name") != "") {
+		return errors.New("--notify and --instance-name need the session bus, so can't be used with --no-session-bus")
+	}
+	if num("failure-threshold") < 0 {
+		return errors.New("--failure-threshold can't be negative")
+	}
+	if flagValue(fs, "poll-interval").(time.Duration) <= 0 {
+		return errors.New("--poll-interval must be positive")
+	}
+	if str("syslog") != "" && str("logfile") != "" {
+		return errors.New("--syslog and --logfile can't be used together")
+	}
+	return nil
+}
+
+// logOut is the currently open --logfile, if any, and logPath the
+// path it was opened at. Both are only used by the main goroutine.
+var (
+	logOut  *os.File
+	logPath string
+)
+
+// openLogfile directs logging to --logfile, if set, closing any file
+// previously opened. The file is truncated first if truncate is true.
+func openLogfile(path string, truncate bool) error {
+	if path == "" {
+		if logOut != nil {
+			log.SetOutput(os.Stderr)
+			logOut.Close()
+			logOut = nil
+		}
+		logPath = ""
+		return nil
+	}
+
+	mode := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if truncate {
+		mode |= os.O_TRUNC
+	}
+	lf, err := os.OpenFile(path, mode, 0600)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(lf)
+	if logOut != nil {
+		logOut.Close()
+	}
+	logOut, logPath = lf, path
+	return nil
+}
+
+// reopenLogfile opens the logfile at path, if any, so that once it has
+// been rotated we write to the new file rather than the old one. The
+// log prefix and flags are untouched.
+func reopenLogfile(path string) {
+	if err := openLogfile(path, false); err != nil {
+		reallyLog("Couldn't reopen logfile %q: %v", path, err)
+		return
+	}
+	if path != "" {
+		maybeLog("reopened logfile %q", path)
+	}
+}
+
+// reload re-reads the config file and reopens the logfile, then
+// updates our actions. The power state is left alone, so no action is
+// run. The new settings are worked out and checked apart from the live
+// flags, which are never changed, so if the config can't be loaded the
+// previous settings stay in effect.
+func (p *powermon) reload() {
+	fs, err := loadSettings()
+	if err != nil {
+		reallyLog("Couldn't reload config: %v", err)
+		// The logfile may still have been rotated.
+		reopenLogfile(logPath)
+		return
+	}
+	reopenLogfile(fs.Lookup("logfile").Value.String())
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if !reloadable[f.Name] && f.Value.String() != flag.Lookup(f.Name).Value.String() {
+			warnLog("--%s has changed, but only takes effect on restart", f.Name)
+		}
+	})
+
+	acts := actionsFrom(fs)
+	if err := acts.checkNeeded(); err != nil {
+		reallyLog("%v; keeping previous actions", err)
+		return
+	}
+	if err := acts.validate(); err != nil {
+		reallyLog("%v; keeping previous actions", err)
+		return
+	}
+	p.setActions(acts)
+	maybeLog("configuration reloaded")
+}
+
+// sessionBusIfWanted connects to the session bus unless
+// --no-session-bus is set. When it can't be reached, as over SSH, we
+// carry on without it, returning nil, unless --notify or
+// --instance-name show that it's wanted.
+func sessionBusIfWanted() (busConn, error) {
+	if *noSessBus {
+		return nil, nil
+	}
+	bus, err := connectSessionBus()
+	if err != nil && !*notifyFlag && *instance == "" {
+		warnLog("couldn't connect to the session bus, so running without it: %v", err)
+		return nil, nil
+	}
+	return bus, err
+}
+
+// printState writes the current power state to stdout, returning the
+// process exit code.
+func printState() int {
+	bus, err := dialSystemBus()
+	if err != nil {
+		reallyLog("system bus connect failed: %v", err)
+		return 1
+	}
+	defer bus.Close()
+
+	state, err := chooseSource(&bus, upowerFromFlags()).read()
+	if err != nil {
+		reallyLog("failed to get battery state: %v", err)
+		return 1
+	}
+	fmt.Println(state.state.arg())
+	return 0
+}
+
+// runOnce runs the actions for the current power state, without
+// monitoring for changes, returning the process exit code: that of the
+// last action run. Cancelling ctx kills the running action.
+func runOnce(ctx context.Context, acts actions) int {
+	if err := acts.validate(); err != nil {
+		reallyLog("%v", err)
+		return 1
+	}
+
+	sysBus, err := dialSystemBus()
+	if err != nil {
+		reallyLog("system bus connect failed: %v", err)
+		return 1
+	}
+	defer sysBus.Close()
+
+	p := &powermon{
+		ctx:     ctx,
+		sysBus:  sysBus,
+		upower:  upowerFromFlags(),
+		actions: acts,
+
+		commands:   make(chan command, commandQueueLen),
+		workerDone: make(chan struct{}),
+	}
+	if *startWait > 0 && *backend != "sysfs" {
+		if err := p.upower.waitFor(sysBus, *startWait); err != nil {
+			reallyLog("%v", err)
+			return 1
+		}
+	}
+	p.source = chooseSource(&p.sysBus, p.upower)
+	if !p.onUPower() && trackBatteries() {
+		reallyLog("--aggregate-batteries and --per-battery need the upower backend")
+		return 1
+	}
+	if err := p.refreshState(); err != nil {
+		reallyLog("failed to get battery state: %v", err)
+		return 1
+	}
+	if trackBatteries() {
+		p.refreshBatteries()
+	}
+
+	go p.worker()
+	p.stateChange()
+	close(p.commands)
+	<-p.workerDone
+
+	if code := p.lastExit; code >= 0 {
+		return code
+	}
+	return 1
 }
 
 func main() {
 	flag.Parse()
 
-	if *logfile != "" {
-		lf, err := os.OpenFile(*logfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-		if err != nil {
-			log.Fatalf("Couldn't open logfile %q: %v\n", *logfile, err)
-		}
-		log.SetOutput(lf)
+	if *showVer {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+
+	if err := readConfig(flag.CommandLine); err != nil {
+		log.Fatalf("Couldn't load config: %v\n", err)
+	}
+	if err := checkFlags(flag.CommandLine); err != nil {
+		log.Fatalf("%v\n", err)
 	}
 
 	prog, err := os.Executable()
 	if err != nil {
-		maybeLog("Error determining program executable: %v\n", err)
+		reallyLog("Error determining program executable: %v\n", err)
+		os.Exit(1)
+	}
+
+	if syslogTo.facility != "" {
+		tag := *syslogTag
+		if tag == "" {
+			tag = filepath.Base(prog)
+		}
+		if err := openSyslog(syslogTo.facility, tag); err != nil {
+			log.Fatalf("Couldn't connect to syslog: %v\n", err)
+		}
+	}
+
+	if err := openLogfile(*logfile, *logTrunc); err != nil {
+		log.Fatalf("Couldn't open logfile %q: %v\n", *logfile, err)
+	}
+
+	if *logHost {
+		readLogIdentity()
+	}
+	log.SetPrefix(identityPrefix() + filepath.Base(prog) + ": ")
+
+	if *query {
+		os.Exit(printState())
+	}
+	if *listDevs {
+		os.Exit(listDevices())
+	}
+
+	acts := actionsFrom(flag.CommandLine)
+	if err := acts.checkNeeded(); err != nil {
+		reallyLog("%v", err)
+		os.Exit(1)
+	}
+
+	if runAs.cred, runAs.env, err = resolveRunAs(*runAsUser, *runAsGroup); err != nil {
+		reallyLog("Setup failure: %v\n", err)
 		os.Exit(1)
 	}
 
-	log.SetPrefix(filepath.Base(prog) + ": ")
+	// Without run() to handle them, SIGINT and SIGTERM cancel this,
+	// killing any action's process group rather than orphaning it.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 
-	if *actionCmd == "" {
-		maybeLog("No action to run on state change. Pass --action='/some/command'.")
+	if *stdinEvts {
+		if *once {
+			log.Fatalf("--stdin-events and --once can't be used together\n")
+		}
+		os.Exit(runStdinEvents(ctx, acts, os.Stdin))
+	}
+
+	if *once {
+		if *noInitial {
+			log.Fatalf("--once and --no-initial-action can't be used together\n")
+		}
+		if acts.empty() {
+			log.Fatalf("--once needs an action to run\n")
+		}
+		os.Exit(runOnce(ctx, acts))
+	}
+
+	stop()
+
+	sessBus, err := sessionBusIfWanted()
+	if err != nil {
+		reallyLog("Setup failure: session bus connect failed: %v\n", err)
+		os.Exit(1)
+	}
+	sysBus, err := dialSystemBus()
+	if err != nil {
+		reallyLog("Setup failure: system bus connect failed: %v\n", err)
 		os.Exit(1)
 	}
 
-	pm, err := newPowermon(*actionCmd)
+	pm, err := newPowermon(acts, sysBus, sessBus)
 	if err != nil {
-		maybeLog("Setup failure: %v\n", err)
+		reallyLog("Setup failure: %v\n", err)
 		os.Exit(1)
 	}
 
+	if *metrics != "" {
+		if err := pm.startMetrics(*metrics); err != nil {
+			reallyLog("Setup failure: %v\n", err)
+			if pm.pidfile != "" {
+				removePidfile(pm.pidfile)
+			}
+			os.Exit(1)
+		}
+	}
+
 	go pm.run()
 
 	sigQuit := make(chan os.Signal, 1)
-	signal.Notify(sigQuit, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigQuit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	for {
 		select {
 		case s := <-sigQuit:
+			if s == syscall.SIGHUP {
+				maybeLog("received signal %q. reloading...", s)
+				pm.reload()
+				continue
+			}
 			maybeLog("received signal %q. shutting down...", s)
 			pm.shutdown()
 			maybeLog("goodbye")
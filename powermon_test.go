@@ -0,0 +1,702 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// fakeBus is a busConn standing in for the system bus. Its objects'
+// properties are kept in props, by path and then by qualified name, and
+// signals are delivered with send.
+type fakeBus struct {
+	mu      sync.Mutex
+	props   map[dbus.ObjectPath]map[string]dbus.Variant
+	signals []chan<- *dbus.Signal
+	matches int
+	// unheard counts match rules added while nothing was listening
+	// for signals, whose first signals could be lost.
+	unheard int
+	// calls lists the methods called on the bus's objects, other
+	// than property reads.
+	calls []string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var errNotFaked = errors.New("not faked")
+
+// newFakeBus returns a fakeBus with UPower on AC power and a display
+// device holding a charging battery at 80%.
+func newFakeBus() *fakeBus {
+	ctx, cancel := context.WithCancel(context.Background())
+	u := upowerFromFlags()
+	return &fakeBus{
+		props: map[dbus.ObjectPath]map[string]dbus.Variant{
+			u.path: {
+				u.iface + "." + onBattery:   dbus.MakeVariant(false),
+				u.iface + "." + lidIsClosed: dbus.MakeVariant(false),
+			},
+			u.displayDevice(): {
+				u.device() + "." + deviceState:  dbus.MakeVariant(deviceCharging),
+				u.device() + "." + isPresent:    dbus.MakeVariant(true),
+				u.device() + "." + percentage:   dbus.MakeVariant(80.0),
+				u.device() + "." + warningLevel: dbus.MakeVariant(uint32(1)),
+			},
+		},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// set changes the property name of the object at path.
+func (b *fakeBus) set(path dbus.ObjectPath, name string, v interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.props[path][name] = dbus.MakeVariant(v)
+}
+
+// send delivers sig to everyone listening for signals.
+func (b *fakeBus) send(sig *dbus.Signal) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.signals {
+		c <- sig
+	}
+}
+
+func (b *fakeBus) Object(dest string, path dbus.ObjectPath) dbus.BusObject {
+	return fakeObject{bus: b, path: path}
+}
+
+func (b *fakeBus) AddMatchSignal(options ...dbus.MatchOption) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.matches++
+	if len(b.signals) == 0 {
+		b.unheard++
+	}
+	return nil
+}
+
+func (b *fakeBus) RemoveMatchSignal(options ...dbus.MatchOption) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.matches--
+	return nil
+}
+
+func (b *fakeBus) Signal(ch chan<- *dbus.Signal) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.signals = append(b.signals, ch)
+}
+
+func (b *fakeBus) RemoveSignal(ch chan<- *dbus.Signal) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, c := range b.signals {
+		if c == ch {
+			b.signals = append(b.signals[:i], b.signals[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *fakeBus) RequestName(name string, flags dbus.RequestNameFlags) (dbus.RequestNameReply, error) {
+	return dbus.RequestNameReplyPrimaryOwner, nil
+}
+
+func (b *fakeBus) Export(v interface{}, path dbus.ObjectPath, iface string) error {
+	return nil
+}
+
+func (b *fakeBus) Emit(path dbus.ObjectPath, name string, values ...interface{}) error {
+	return nil
+}
+
+func (b *fakeBus) Context() context.Context {
+	return b.ctx
+}
+
+// Close closes the signal channels, as godbus does when a connection
+// is lost.
+func (b *fakeBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ctx.Err() == nil {
+		for _, c := range b.signals {
+			close(c)
+		}
+		b.signals = nil
+		b.cancel()
+	}
+	return nil
+}
+
+// fakeObject is an object on a fakeBus. Only the methods powermon uses
+// are implemented.
+type fakeObject struct {
+	dbus.BusObject
+	bus  *fakeBus
+	path dbus.ObjectPath
+}
+
+func (o fakeObject) GetProperty(name string) (dbus.Variant, error) {
+	o.bus.mu.Lock()
+	defer o.bus.mu.Unlock()
+	v, ok := o.bus.props[o.path][name]
+	if !ok {
+		return dbus.Variant{}, errNotFaked
+	}
+	return v, nil
+}
+
+func (o fakeObject) CallWithContext(ctx context.Context, method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	return o.Call(method, flags, args...)
+}
+
+func (o fakeObject) Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	o.bus.mu.Lock()
+	o.bus.calls = append(o.bus.calls, method)
+	o.bus.mu.Unlock()
+	if method == upowerFromFlags().iface+"."+enumerateDevices {
+		return &dbus.Call{Body: []interface{}{[]dbus.ObjectPath{}}}
+	}
+	return &dbus.Call{Err: errNotFaked}
+}
+
+// newTestPowermon returns a powermon reading UPower from bus, with
+// action as its action. Its queue is read by the test rather than a
+// worker. The initial state's commands are left queued.
+func newTestPowermon(t *testing.T, bus *fakeBus, action string) *powermon {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	p := &powermon{
+		ctx:     ctx,
+		cancel:  cancel,
+		sysBus:  bus,
+		upower:  upowerFromFlags(),
+		runDone: make(chan struct{}),
+		states:  make(chan sourceState),
+		actions: actions{action: []string{action}},
+
+		actionReqs: make(chan chan manualRun),
+		commands:   make(chan command, commandQueueLen),
+		workerDone: make(chan struct{}),
+	}
+	p.source = upowerSource{p.upower, &p.sysBus}
+	if err := p.refreshState(); err != nil {
+		t.Fatalf("refreshState() = %v", err)
+	}
+	p.stateChange()
+	return p
+}
+
+// queued returns the commands waiting in p's queue, emptying it.
+func queued(p *powermon) []command {
+	var cmds []command
+	for {
+		select {
+		case c := <-p.commands:
+			cmds = append(cmds, c)
+		default:
+			return cmds
+		}
+	}
+}
+
+// propsSignal returns a PropertiesChanged signal for changes to the
+// properties of iface at path.
+func propsSignal(path dbus.ObjectPath, iface string, changes map[string]interface{}) *dbus.Signal {
+	changed := make(map[string]dbus.Variant)
+	for k, v := range changes {
+		changed[k] = dbus.MakeVariant(v)
+	}
+	return &dbus.Signal{
+		Sender: defaultUPowerDest,
+		Path:   path,
+		Name:   propertiesChanged,
+		Body:   []interface{}{iface, changed, []string{}},
+	}
+}
+
+// hasEnv reports whether env sets kv, a KEY=VALUE pair.
+func hasEnv(env []string, kv string) bool {
+	for _, e := range env {
+		if e == kv {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInitialStateQueuesAction(t *testing.T) {
+	p := newTestPowermon(t, newFakeBus(), "/bin/act")
+	cmds := queued(p)
+	if len(cmds) != 1 {
+		t.Fatalf("got %d commands for the initial state, want 1", len(cmds))
+	}
+	c := cmds[0]
+	if c.name != "/bin/act" || strings.Join(c.args, " ") != "CHARGING 80" {
+		t.Errorf("got %s %q, want /bin/act [CHARGING 80]", c.name, c.args)
+	}
+	if !hasEnv(c.env, "POWERMON_PREV_STATE=UNKNOWN") {
+		t.Errorf("env %q lacks POWERMON_PREV_STATE=UNKNOWN", c.env)
+	}
+}
+
+func TestPropertiesChangedQueuesAction(t *testing.T) {
+	u := upowerFromFlags()
+	tests := []struct {
+		desc string
+		// props are set on the display device before the
+		// signal is sent.
+		props map[string]interface{}
+		sig   *dbus.Signal
+		// want is the arguments of the one command expected,
+		// or nil for none.
+		want     []string
+		wantPrev string
+	}{{
+		desc:     "unplugged",
+		props:    map[string]interface{}{deviceState: deviceDischarging, percentage: 79.0},
+		sig:      propsSignal(u.path, u.iface, map[string]interface{}{onBattery: true}),
+		want:     []string{"DISCHARGING", "79"},
+		wantPrev: "CHARGING",
+	}, {
+		desc:     "charged",
+		props:    map[string]interface{}{percentage: 100.0},
+		sig:      propsSignal(u.displayDevice(), u.device(), map[string]interface{}{deviceState: deviceFullyCharged}),
+		want:     []string{"FULL", "100"},
+		wantPrev: "CHARGING",
+	}, {
+		desc: "percentage only",
+		sig:  propsSignal(u.displayDevice(), u.device(), map[string]interface{}{percentage: 81.0}),
+	}, {
+		desc: "another device",
+		sig:  propsSignal("/org/freedesktop/UPower/devices/battery_BAT1", u.device(), map[string]interface{}{deviceState: deviceDischarging}),
+	}, {
+		desc: "another interface",
+		sig:  propsSignal(u.path, "org.example.Other", map[string]interface{}{onBattery: true}),
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			bus := newFakeBus()
+			p := newTestPowermon(t, bus, "/bin/act")
+			queued(p)
+			for k, v := range tc.props {
+				bus.set(u.displayDevice(), u.device()+"."+k, v)
+			}
+
+			p.handleSignal(tc.sig)
+			cmds := queued(p)
+			if tc.want == nil {
+				if len(cmds) != 0 {
+					t.Fatalf("got commands %v, want none", cmds)
+				}
+				return
+			}
+			if len(cmds) != 1 {
+				t.Fatalf("got %d commands, want 1", len(cmds))
+			}
+			if got := cmds[0].args; strings.Join(got, " ") != strings.Join(tc.want, " ") {
+				t.Errorf("got args %q, want %q", got, tc.want)
+			}
+			if kv := "POWERMON_PREV_STATE=" + tc.wantPrev; !hasEnv(cmds[0].env, kv) {
+				t.Errorf("env %q lacks %s", cmds[0].env, kv)
+			}
+		})
+	}
+}
+
+func TestArgFormat(t *testing.T) {
+	defer func(f string) { *argFormat = f }(*argFormat)
+	u := upowerFromFlags()
+	for format, want := range map[string]string{"enum": "DISCHARGING", "short": "battery", "bool": "1"} {
+		*argFormat = format
+		p := newTestPowermon(t, newFakeBus(), "/bin/act")
+		queued(p)
+		p.handleSignal(propsSignal(u.path, u.iface, map[string]interface{}{onBattery: true}))
+		cmds := queued(p)
+		if len(cmds) != 1 || cmds[0].args[0] != want {
+			t.Errorf("with --arg-format=%s got %v, want one command passed %q", format, cmds, want)
+		}
+	}
+}
+
+// startRun runs p's main loop, listening for signals on its bus, until
+// the test ends.
+func startRun(t *testing.T, p *powermon) {
+	t.Helper()
+	p.sigC = listen(p.sysBus)
+	go p.run()
+	t.Cleanup(func() {
+		p.cancel()
+		<-p.runDone
+	})
+}
+
+// nextCommand waits for p to queue a command, failing the test if it
+// doesn't soon.
+func nextCommand(t *testing.T, p *powermon) command {
+	t.Helper()
+	select {
+	case c := <-p.commands:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a command")
+	}
+	return command{}
+}
+
+func TestRunActsOnSignals(t *testing.T) {
+	u := upowerFromFlags()
+	bus := newFakeBus()
+	p := newTestPowermon(t, bus, "/bin/act")
+	queued(p)
+	startRun(t, p)
+
+	bus.set(u.displayDevice(), u.device()+"."+deviceState, deviceDischarging)
+	bus.send(propsSignal(u.path, u.iface, map[string]interface{}{onBattery: true}))
+	if c := nextCommand(t, p); c.args[0] != "DISCHARGING" {
+		t.Errorf("after unplugging got args %q, want DISCHARGING first", c.args)
+	}
+
+	bus.set(u.displayDevice(), u.device()+"."+deviceState, deviceCharging)
+	bus.send(propsSignal(u.path, u.iface, map[string]interface{}{onBattery: false}))
+	c := nextCommand(t, p)
+	if c.args[0] != "CHARGING" {
+		t.Errorf("after plugging in got args %q, want CHARGING first", c.args)
+	}
+	if !hasEnv(c.env, "POWERMON_PREV_STATE=DISCHARGING") {
+		t.Errorf("env %q lacks POWERMON_PREV_STATE=DISCHARGING", c.env)
+	}
+	if c.gen != p.stateGen.Load() {
+		t.Errorf("command has gen %d, want the latest, %d", c.gen, p.stateGen.Load())
+	}
+}
+
+func TestRunReconnects(t *testing.T) {
+	u := upowerFromFlags()
+	bus := newFakeBus()
+	p := newTestPowermon(t, bus, "/bin/act")
+	queued(p)
+
+	// The state changes while we're disconnected.
+	next := newFakeBus()
+	next.set(u.path, u.iface+"."+onBattery, true)
+	redialed := make(chan struct{})
+	p.redial = func() (busConn, error) {
+		close(redialed)
+		return next, nil
+	}
+	startRun(t, p)
+
+	bus.Close()
+	select {
+	case <-redialed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for redial")
+	}
+	// Resyncing after the reconnect notices the change.
+	if c := nextCommand(t, p); c.args[0] != "DISCHARGING" {
+		t.Errorf("after reconnecting got args %q, want DISCHARGING first", c.args)
+	}
+
+	// Signals now come from the new connection.
+	next.set(u.path, u.iface+"."+onBattery, false)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		next.mu.Lock()
+		listening := len(next.signals) > 0
+		next.mu.Unlock()
+		if listening {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("run() never listened on the new connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	next.send(propsSignal(u.path, u.iface, map[string]interface{}{onBattery: false}))
+	if c := nextCommand(t, p); c.args[0] != "CHARGING" {
+		t.Errorf("after a signal on the new connection got args %q, want CHARGING first", c.args)
+	}
+	next.mu.Lock()
+	defer next.mu.Unlock()
+	if next.unheard != 0 {
+		t.Errorf("%d match rules were added before listening on the new connection", next.unheard)
+	}
+}
+
+func TestMalformedSignalsIgnored(t *testing.T) {
+	u := upowerFromFlags()
+	type handler func(*powermon, *dbus.Signal)
+	signal := func(path dbus.ObjectPath, name string, body ...interface{}) *dbus.Signal {
+		return &dbus.Signal{Sender: defaultUPowerDest, Path: path, Name: name, Body: body}
+	}
+	props := func(body ...interface{}) *dbus.Signal {
+		return signal(u.path, propertiesChanged, body...)
+	}
+	byName := func(name string) string { return u.iface + "." + name }
+	tests := []struct {
+		desc   string
+		handle handler
+		sig    *dbus.Signal
+	}{
+		{"properties with no body", (*powermon).propertiesChanged, props()},
+		{"properties with one value", (*powermon).propertiesChanged, props(u.iface)},
+		{"properties with a numeric interface", (*powermon).propertiesChanged, props(42, map[string]dbus.Variant{}, []string{})},
+		{"properties with changes as a string", (*powermon).propertiesChanged, props(u.iface, "OnBattery", []string{})},
+		{"OnBattery as a string", (*powermon).propertiesChanged, props(u.iface, map[string]dbus.Variant{onBattery: dbus.MakeVariant("yes")}, []string{})},
+		{"LidIsClosed as a number", (*powermon).propertiesChanged, props(u.iface, map[string]dbus.Variant{lidIsClosed: dbus.MakeVariant(1)}, []string{})},
+		{"State as a string", (*powermon).propertiesChanged, signal(u.displayDevice(), propertiesChanged, u.device(), map[string]dbus.Variant{deviceState: dbus.MakeVariant("discharging")}, []string{})},
+		{"Percentage as a string", (*powermon).propertiesChanged, signal(u.displayDevice(), propertiesChanged, u.device(), map[string]dbus.Variant{percentage: dbus.MakeVariant("50%")}, []string{})},
+		{"sleep with no body", (*powermon).sleepChanged, signal(login1Path, prepareForSleep)},
+		{"sleep as a string", (*powermon).sleepChanged, signal(login1Path, prepareForSleep, "true")},
+		{"sleep with two values", (*powermon).sleepChanged, signal(login1Path, prepareForSleep, true, false)},
+		{"owner with no body", (*powermon).ownerChanged, signal("/org/freedesktop/DBus", nameOwnerChanged)},
+		{"owner with one value", (*powermon).ownerChanged, signal("/org/freedesktop/DBus", nameOwnerChanged, defaultUPowerDest)},
+		{"owner with numbers", (*powermon).ownerChanged, signal("/org/freedesktop/DBus", nameOwnerChanged, 1, 2, 3)},
+		{"device added with no body", (*powermon).deviceChanged, signal(u.path, byName(deviceAdded))},
+		{"device added as a number", (*powermon).deviceChanged, signal(u.path, byName(deviceAdded), 7)},
+		{"device removed as a string slice", (*powermon).deviceChanged, signal(u.path, byName(deviceRemoved), []string{"x"})},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := newTestPowermon(t, newFakeBus(), "/bin/act")
+			p.batteries = make(map[dbus.ObjectPath]bool)
+			queued(p)
+			before := p.getState()
+
+			tc.handle(p, tc.sig)
+			if got := p.getState(); got != before {
+				t.Errorf("state changed from %s to %s", before, got)
+			}
+			if cmds := queued(p); len(cmds) != 0 {
+				t.Errorf("queued %v, want nothing", cmds)
+			}
+		})
+	}
+}
+
+// TestStateReadDuringRun reads the state as the exported D-Bus methods
+// do while run() changes it. It's most useful under -race.
+func TestStateReadDuringRun(t *testing.T) {
+	u := upowerFromFlags()
+	bus := newFakeBus()
+	p := newTestPowermon(t, bus, "/bin/act")
+	queued(p)
+	startRun(t, p)
+
+	stop := make(chan struct{})
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		obj, props := pmonObject{p}, pmonProperties{p}
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			p.getState()
+			p.getPercentage()
+			obj.GetState()
+			props.Get(pmon, currentStateProp)
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		battery := i%2 == 0
+		bus.send(propsSignal(u.path, u.iface, map[string]interface{}{onBattery: battery}))
+		bus.send(propsSignal(u.displayDevice(), u.device(), map[string]interface{}{percentage: float64(50 + i)}))
+		nextCommand(t, p)
+	}
+	close(stop)
+	<-read
+
+	if got := p.getState(); got != CHARGING {
+		t.Errorf("ended in %s, want CHARGING", got)
+	}
+}
+
+func TestUPowerSignalsIgnoredWithOtherBackend(t *testing.T) {
+	u := upowerFromFlags()
+	bus := newFakeBus()
+	p := newTestPowermon(t, bus, "/bin/act")
+	queued(p)
+
+	if err := p.subscribe(bus); err != nil {
+		t.Fatalf("subscribe() = %v", err)
+	}
+	withUPower := bus.matches
+	p.source = sysfsSource{t.TempDir()}
+	other := newFakeBus()
+	if err := p.subscribe(other); err != nil {
+		t.Fatalf("subscribe() = %v", err)
+	}
+	if other.matches != withUPower-2 {
+		t.Errorf("subscribed to %d signals with sysfs, want %d", other.matches, withUPower-2)
+	}
+
+	p.handleSignal(propsSignal(u.path, u.iface, map[string]interface{}{onBattery: true}))
+	if cmds := queued(p); len(cmds) != 0 {
+		t.Errorf("UPower signal with sysfs backend queued %d commands, want 0", len(cmds))
+	}
+	if got := p.getState(); got != CHARGING {
+		t.Errorf("state = %s, want CHARGING", got)
+	}
+}
+
+func TestPerBatteryWithoutBatteries(t *testing.T) {
+	defer func(b bool) { *perBattery = b }(*perBattery)
+	*perBattery = true
+
+	// The fake bus has no batteries.
+	p := newTestPowermon(t, newFakeBus(), "/bin/act")
+	if err := p.checkBattery(); err == nil {
+		t.Error("checkBattery() = nil with --per-battery and no batteries, want an error")
+	}
+	cmds := queued(p)
+	if len(cmds) != 1 {
+		t.Fatalf("got %d commands, want 1", len(cmds))
+	}
+	if got := strings.Join(cmds[0].args, " "); got != "CHARGING 80" {
+		t.Errorf("got args %q, want [CHARGING 80]", cmds[0].args)
+	}
+}
+
+func TestAutoSwitchesToUPowerWhenItAppears(t *testing.T) {
+	defer func(d time.Duration) { *pollEvery = d }(*pollEvery)
+	*pollEvery = 10 * time.Millisecond
+	u := upowerFromFlags()
+	bus := newFakeBus()
+	p := newTestPowermon(t, bus, "/bin/act")
+	queued(p)
+
+	// UPower wasn't running at startup, so auto fell back to sysfs.
+	dir := t.TempDir()
+	bat := filepath.Join(dir, "BAT0")
+	if err := os.Mkdir(bat, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, val := range map[string]string{"type": "Battery", "status": "Discharging", "capacity": "50"} {
+		if err := os.WriteFile(filepath.Join(bat, name), []byte(val+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.source = sysfsSource{dir}
+	p.refreshState()
+	p.startWatch()
+	matches := bus.matches
+
+	p.ownerChanged(&dbus.Signal{Name: nameOwnerChanged, Body: []interface{}{u.dest, "", ":1.42"}})
+	if !p.onUPower() {
+		t.Fatal("still reading sysfs once UPower appeared")
+	}
+	if got := p.getState(); got != CHARGING {
+		t.Errorf("state = %s, want CHARGING from UPower", got)
+	}
+	if bus.matches != matches+2 {
+		t.Errorf("added %d match rules, want 2 for UPower's properties", bus.matches-matches)
+	}
+	// sysfs is no longer polled.
+	select {
+	case s := <-p.states:
+		t.Errorf("sysfs still polled after the switch: got %v", s)
+	case <-time.After(5 * *pollEvery):
+	}
+}
+
+func TestPlugInIsOneChange(t *testing.T) {
+	u := upowerFromFlags()
+	bus := newFakeBus()
+	bus.set(u.path, u.iface+"."+onBattery, true)
+	bus.set(u.displayDevice(), u.device()+"."+deviceState, deviceDischarging)
+	p := newTestPowermon(t, bus, "/bin/act")
+	queued(p)
+
+	// UPower has updated both properties, but signals OnBattery first.
+	bus.set(u.path, u.iface+"."+onBattery, false)
+	bus.set(u.displayDevice(), u.device()+"."+deviceState, deviceCharging)
+	p.handleSignal(propsSignal(u.path, u.iface, map[string]interface{}{onBattery: false}))
+	p.handleSignal(propsSignal(u.displayDevice(), u.device(), map[string]interface{}{deviceState: deviceCharging}))
+
+	cmds := queued(p)
+	if len(cmds) != 1 {
+		t.Fatalf("got %d commands, want 1: %v", len(cmds), cmds)
+	}
+	if got := cmds[0].args[0]; got != "CHARGING" {
+		t.Errorf("got state %s, want CHARGING", got)
+	}
+}
+
+func TestNotifyOnlyOnSupplyChange(t *testing.T) {
+	defer func(b bool) { *notifyFlag = b }(*notifyFlag)
+	*notifyFlag = true
+	sess := newFakeBus()
+	p := newTestPowermon(t, newFakeBus(), "/bin/act")
+	p.sessBus = sess
+
+	// Starting from CHARGING.
+	for _, ps := range []powerState{FULL, DISCHARGING, AC_POWER, CHARGING} {
+		p.setState(ps)
+		p.stateChange()
+	}
+	var notified int
+	for _, c := range sess.calls {
+		if c == notifications+".Notify" {
+			notified++
+		}
+	}
+	if notified != 2 {
+		t.Errorf("sent %d notifications, want 2", notified)
+	}
+}
+
+func TestReconnectFeedsWatchdog(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "notify")
+	ln, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	t.Setenv("NOTIFY_SOCKET", sock)
+
+	p := newTestPowermon(t, newFakeBus(), "/bin/act")
+	tick := make(chan time.Time)
+	p.watchdogC = tick
+	// The bus stays down.
+	p.redial = func() (busConn, error) { return nil, errors.New("no bus") }
+	done := make(chan bool)
+	go func() { done <- p.reconnect() }()
+
+	tick <- time.Now()
+	ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := ln.Read(buf)
+	if err != nil {
+		t.Fatalf("no watchdog notification while reconnecting: %v", err)
+	}
+	if got := string(buf[:n]); got != "WATCHDOG=1" {
+		t.Errorf("got notification %q, want WATCHDOG=1", got)
+	}
+
+	p.cancel()
+	if <-done {
+		t.Error("reconnect() = true after we were asked to quit")
+	}
+}
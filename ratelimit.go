@@ -0,0 +1,38 @@
+package main
+
+import "time"
+
+// tokenBucket limits events to a sustained rate per minute. It holds
+// up to a minute's worth of tokens, so a burst of that many is allowed
+// after a quiet spell.
+type tokenBucket struct {
+	perMinute float64
+	tokens    float64
+	last      time.Time
+}
+
+// newTokenBucket returns a full bucket allowing perMinute events a
+// minute.
+func newTokenBucket(perMinute int) *tokenBucket {
+	return &tokenBucket{
+		perMinute: float64(perMinute),
+		tokens:    float64(perMinute),
+		last:      time.Now(),
+	}
+}
+
+// allow reports whether an event may happen at now, taking a token if
+// so.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Minutes() * b.perMinute
+	if b.tokens > b.perMinute {
+		b.tokens = b.perMinute
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
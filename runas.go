@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// runAs is who actions are run as, set from --run-as-user and
+// --run-as-group at startup. A nil cred runs them as ourselves.
+var runAs struct {
+	cred *syscall.Credential
+	// env describes the user to the action, replacing the values
+	// we inherited.
+	env []string
+}
+
+// resolveRunAs looks up the named user and group, either of which may
+// be empty, returning the credentials to run actions with. The group
+// defaults to the user's primary group, and the user to ourselves.
+func resolveRunAs(userName, groupName string) (*syscall.Credential, []string, error) {
+	if userName == "" && groupName == "" {
+		return nil, nil, nil
+	}
+	if os.Geteuid() != 0 {
+		return nil, nil, errors.New("--run-as-user and --run-as-group need powermon to run as root")
+	}
+
+	cred := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	var env []string
+	if userName != "" {
+		u, err := lookupUser(userName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--run-as-user: %v", err)
+		}
+		if cred.Uid, err = parseID(u.Uid); err != nil {
+			return nil, nil, fmt.Errorf("--run-as-user: bad uid %q: %v", u.Uid, err)
+		}
+		if cred.Gid, err = parseID(u.Gid); err != nil {
+			return nil, nil, fmt.Errorf("--run-as-user: bad gid %q: %v", u.Gid, err)
+		}
+		// Without this the action would keep root's
+		// supplementary groups.
+		gids, err := u.GroupIds()
+		if err != nil {
+			return nil, nil, fmt.Errorf("--run-as-user: couldn't list groups of %q: %v", userName, err)
+		}
+		for _, g := range gids {
+			if id, err := parseID(g); err == nil {
+				cred.Groups = append(cred.Groups, id)
+			}
+		}
+		env = []string{"USER=" + u.Username, "LOGNAME=" + u.Username, "HOME=" + u.HomeDir}
+		// Let actions reach the user's session bus, as
+		// notify-send needs to, if they're logged in.
+		if dir := "/run/user/" + u.Uid; isDir(dir) {
+			env = append(env, "XDG_RUNTIME_DIR="+dir, "DBUS_SESSION_BUS_ADDRESS=unix:path="+dir+"/bus")
+		}
+	}
+	if groupName != "" {
+		g, err := lookupGroup(groupName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--run-as-group: %v", err)
+		}
+		if cred.Gid, err = parseID(g.Gid); err != nil {
+			return nil, nil, fmt.Errorf("--run-as-group: bad gid %q: %v", g.Gid, err)
+		}
+	}
+	return cred, env, nil
+}
+
+// lookupUser finds the user with the given name or, failing that,
+// numeric uid.
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+	if _, perr := parseID(name); perr == nil {
+		if u, ierr := user.LookupId(name); ierr == nil {
+			return u, nil
+		}
+	}
+	return nil, err
+}
+
+// lookupGroup finds the group with the given name or, failing that,
+// numeric gid.
+func lookupGroup(name string) (*user.Group, error) {
+	g, err := user.LookupGroup(name)
+	if err == nil {
+		return g, nil
+	}
+	if _, perr := parseID(name); perr == nil {
+		if g, ierr := user.LookupGroupId(name); ierr == nil {
+			return g, nil
+		}
+	}
+	return nil, err
+}
+
+// isDir reports whether path is a directory.
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// parseID parses a numeric uid or gid.
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state, such as "READY=1", to the service manager
+// named by $NOTIFY_SOCKET, as described in sd_notify(3). It does
+// nothing when we aren't running under systemd.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// A leading '@' denotes an abstract socket.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often to send "WATCHDOG=1", half the
+// timeout systemd passes in $WATCHDOG_USEC, or 0 if the watchdog isn't
+// enabled for us.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// feedWatchdog tells systemd that we're still alive.
+func feedWatchdog() {
+	if err := sdNotify("WATCHDOG=1"); err != nil {
+		warnLog("couldn't feed systemd watchdog: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// powerSource is a backend from which we learn the power state, such
+// as UPower or the kernel's sysfs.
+type powerSource interface {
+	// read returns the power state as the source currently sees it.
+	// On failure the state is UNKNOWN.
+	read() (sourceState, error)
+	// percentage returns the battery charge level.
+	percentage() (float64, error)
+	// hasBattery reports whether there is any battery at all.
+	hasBattery() (bool, error)
+	// watch sends the power state on c each time it may have
+	// changed, until ctx is done.
+	watch(ctx context.Context, c chan<- sourceState)
+}
+
+// sourceState is a power state reported by a powerSource.
+type sourceState struct {
+	state powerState
+	// devState and warningLevel are the State and WarningLevel of
+	// the UPower device we watch, or the nearest the source can
+	// tell.
+	devState, warningLevel uint32
+}
+
+// chooseSource returns the powerSource selected by --backend. With
+// --backend=auto, sysfs is only used if UPower isn't on the bus but the
+// kernel reports some power supplies. bus points at the system bus
+// connection, which may be replaced after a disconnect.
+func chooseSource(bus *busConn, u upowerService) powerSource {
+	ups := upowerSource{u, bus}
+	switch *backend {
+	case "upower":
+		return ups
+	case "sysfs":
+		return sysfsSource{*sysfsRoot}
+	}
+	if _, err := u.readOnBattery(*bus); !serviceUnknown(err) {
+		return ups
+	}
+	if _, err := readSysfs(*sysfsRoot); err != nil {
+		debugLog("not falling back to sysfs: %v", err)
+		return ups
+	}
+	maybeLog("%s isn't available; polling %s instead", u.dest, *sysfsRoot)
+	return sysfsSource{*sysfsRoot}
+}
+
+// checkBattery handles there being no battery, as on a desktop,
+// according to --no-battery: either by saying so and carrying on, to
+// follow AC power alone, or by returning an error. --per-battery is
+// always an error without one.
+func (p *powermon) checkBattery() error {
+	ok, err := p.source.hasBattery()
+	if err != nil {
+		debugLog("couldn't tell whether there's a battery: %v", err)
+		return nil
+	}
+	if ok {
+		return nil
+	}
+	if *perBattery {
+		return errors.New("no battery found; --per-battery needs at least one")
+	}
+	if *noBattery == "exit" {
+		return errors.New("no battery found; pass --no-battery=ac-only to monitor AC power alone")
+	}
+	maybeLog("no battery found; monitoring AC power only")
+	acts := p.getActions()
+	for _, a := range []struct{ flag, cmd string }{
+		{"low-action", acts.lowAction},
+		{"critical-action", acts.criticalAction},
+		{"full-action", acts.fullAction},
+	} {
+		if a.cmd != "" {
+			warnLog("--%s is set, but will never run without a battery", a.flag)
+		}
+	}
+	return nil
+}
+
+// record makes s our current state.
+func (p *powermon) record(s sourceState) {
+	p.devState = s.devState
+	p.warningLevel = s.warningLevel
+	p.setState(s.state)
+}
+
+// refreshState re-reads the power state from our source. On failure
+// the state becomes UNKNOWN.
+func (p *powermon) refreshState() error {
+	s, err := p.source.read()
+	p.record(s)
+	return err
+}
+
+// refreshPercentage re-reads the battery percentage from our source.
+func (p *powermon) refreshPercentage() {
+	pct, err := p.source.percentage()
+	if err != nil {
+		debugLog("no battery percentage available: %v", err)
+		p.clearPercentage()
+		return
+	}
+	p.setPercentage(pct)
+}
+
+// sourceChanged is called from run() when our source's watch delivers
+// a state, acting on any change.
+func (p *powermon) sourceChanged(s sourceState) {
+	old := p.getState()
+	p.record(s)
+	if s.state != old {
+		p.changed()
+	}
+	p.refreshPercentage()
+	p.checkThresholds()
+	p.updateStateFile()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// updateStateFile writes our state and battery percentage to
+// --state-file, if set, as KEY=VALUE lines. The file is replaced by
+// rename, so readers never see it half written. It is only rewritten
+// when its contents would change.
+func (p *powermon) updateStateFile() {
+	if p.stateFile == "" {
+		return
+	}
+	pctArg := "-1"
+	if pct, ok := p.getPercentage(); ok {
+		pctArg = fmt.Sprintf("%.0f", pct)
+	}
+	contents := fmt.Sprintf("STATE=%s\nPERCENTAGE=%s\n", p.getState(), pctArg)
+	if contents == p.stateFileContents {
+		return
+	}
+	if err := writeFileAtomic(p.stateFile, []byte(contents)); err != nil {
+		warnLog("couldn't write state file: %v", err)
+		return
+	}
+	p.stateFileContents = contents
+}
+
+// writeFileAtomic replaces the file at path with one holding data.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	// CreateTemp makes the file private, but the state is for
+	// anyone to read.
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// removeStateFile removes --state-file, if we wrote one.
+func (p *powermon) removeStateFile() {
+	if p.stateFileContents == "" {
+		return
+	}
+	if err := os.Remove(p.stateFile); err != nil {
+		warnLog("couldn't remove state file: %v", err)
+	}
+}
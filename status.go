@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"time"
+)
+
+// statusWriteTimeout bounds how long a status client may take to read
+// its reply.
+const statusWriteTimeout = 5 * time.Second
+
+// status is the JSON document written to status socket clients.
+type status struct {
+	State string `json:"state"`
+	// LastTransition is omitted until the state has changed
+	// after startup.
+	LastTransition *time.Time `json:"last_transition,omitempty"`
+	// LastExitCode is null until an action has run.
+	LastExitCode *int `json:"last_exit_code"`
+}
+
+// setLastTransition records when the state last changed.
+func (p *powermon) setLastTransition(t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastTransition = t
+}
+
+// setLastExit records the exit code of the most recent action.
+func (p *powermon) setLastExit(code int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastExit = code
+	p.hasRun = true
+}
+
+// getStatus returns a snapshot of our status.
+func (p *powermon) getStatus() status {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	st := status{State: p.state.String()}
+	if !p.lastTransition.IsZero() {
+		t := p.lastTransition
+		st.LastTransition = &t
+	}
+	if p.hasRun {
+		code := p.lastExit
+		st.LastExitCode = &code
+	}
+	return st
+}
+
+// startStatus listens on the Unix socket at path, answering each
+// connection with our status. A socket left behind by a previous run
+// is replaced, but one that is still being served, or anything other
+// than a socket, is an error.
+func (p *powermon) startStatus(path string) error {
+	if fi, err := os.Lstat(path); err == nil {
+		// Whatever else is there may be someone's data.
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("status socket %q exists and isn't a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return fmt.Errorf("status socket %q is in use", path)
+		}
+		maybeLog("removing stale status socket %q", path)
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("couldn't remove stale status socket: %v", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("status socket %q: %v", path, err)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("status socket listen failed: %v", err)
+	}
+	p.statusLn = ln
+
+	go p.serveStatus()
+	return nil
+}
+
+// serveStatus answers status socket connections until the listener is
+// closed.
+func (p *powermon) serveStatus() {
+	for {
+		c, err := p.statusLn.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				reallyLog("status socket accept failed: %v", err)
+			}
+			return
+		}
+
+		c.SetWriteDeadline(time.Now().Add(statusWriteTimeout))
+		if err := json.NewEncoder(c).Encode(p.getStatus()); err != nil {
+			warnLog("status socket write failed: %v", err)
+		}
+		c.Close()
+	}
+}
+
+// stopStatus closes the status socket, if open, which also removes it.
+func (p *powermon) stopStatus() {
+	if p.statusLn == nil {
+		return
+	}
+	if err := p.statusLn.Close(); err != nil {
+		warnLog("status socket close: %v", err)
+	}
+}
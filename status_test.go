@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStartStatusReplacesOnlyStaleSockets(t *testing.T) {
+	dir := t.TempDir()
+
+	// A socket left behind by a run that didn't clean up.
+	stale := filepath.Join(dir, "stale")
+	ln, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	p := &powermon{}
+	if err := p.startStatus(stale); err != nil {
+		t.Errorf("startStatus() over a stale socket = %v, want nil", err)
+	}
+	p.stopStatus()
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("precious"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p = &powermon{}
+	if err := p.startStatus(file); err == nil {
+		p.stopStatus()
+		t.Error("startStatus() over a regular file = nil, want an error")
+	}
+	if b, err := os.ReadFile(file); err != nil || string(b) != "precious" {
+		t.Errorf("regular file now holds %q (%v), want %q", b, err, "precious")
+	}
+}
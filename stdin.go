@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// stdinSource is a powerSource holding whatever state was last read
+// by runStdinEvents, for testing actions without real hardware.
+type stdinSource struct {
+	state    powerState
+	devState uint32
+	pct      float64
+	hasPct   bool
+}
+
+func (s *stdinSource) read() (sourceState, error) {
+	return sourceState{state: s.state, devState: s.devState}, nil
+}
+
+func (s *stdinSource) percentage() (float64, error) {
+	if !s.hasPct {
+		return 0, errors.New("no percentage given")
+	}
+	return s.pct, nil
+}
+
+func (s *stdinSource) hasBattery() (bool, error) {
+	return s.hasPct, nil
+}
+
+// watch returns at once: runStdinEvents feeds us itself.
+func (s *stdinSource) watch(ctx context.Context, c chan<- sourceState) {}
+
+// parseEvent sets s from an event line: "battery", "ac" or "unknown",
+// or any power state name, optionally followed by the battery
+// percentage.
+func (s *stdinSource) parseEvent(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) > 2 {
+		return fmt.Errorf("too many fields in %q", line)
+	}
+
+	s.devState = deviceUnknown
+	switch ev := strings.ToUpper(fields[0]); ev {
+	case "BATTERY", "ON_BATTERY", "DISCHARGING":
+		s.state = ON_BATTERY
+	case "AC", "AC_POWER":
+		s.state = AC_POWER
+	case "CHARGING":
+		s.state, s.devState = AC_POWER, deviceCharging
+	case "FULL":
+		s.state, s.devState = AC_POWER, deviceFullyCharged
+	case "UNKNOWN":
+		s.state = UNKNOWN
+	default:
+		return fmt.Errorf("unknown event %q; use battery, ac or unknown", fields[0])
+	}
+	s.state = deriveState(s.state, s.devState)
+
+	s.hasPct = false
+	if len(fields) == 2 {
+		pct, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("bad percentage %q: %v", fields[1], err)
+		}
+		s.pct, s.hasPct = pct, true
+	}
+	return nil
+}
+
+// runStdinEvents runs the actions for power states read from r, one
+// event per line, without touching D-Bus, until EOF or ctx is
+// cancelled. Each event's actions finish before the next is read.
+// Blank lines and those starting with '#' are ignored, as are, with a
+// warning, events that can't be parsed. It returns the process exit
+// code.
+func runStdinEvents(ctx context.Context, acts actions, r io.Reader) int {
+	if err := acts.validate(); err != nil {
+		reallyLog("%v", err)
+		return 1
+	}
+	// Only UPower can say what batteries there are.
+	if trackBatteries() {
+		reallyLog("--aggregate-batteries and --per-battery need the upower backend")
+		return 1
+	}
+
+	src := &stdinSource{}
+	p := &powermon{
+		ctx:     ctx,
+		source:  src,
+		actions: acts,
+		inline:  true,
+	}
+	if *maxRate > 0 {
+		p.limiter = newTokenBucket(*maxRate)
+	}
+	p.breaker = newBreaker(*failLimit, *coolDown)
+
+	// Lines are read separately so that waiting for one doesn't stop
+	// us noticing cancellation.
+	lines := make(chan string)
+	var readErr error
+	go func() {
+		defer close(lines)
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			select {
+			case lines <- s.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+		readErr = s.Err()
+	}()
+
+	first := true
+	for {
+		var line string
+		var ok bool
+		select {
+		case line, ok = <-lines:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			maybeLog("interrupted; exiting")
+			return 1
+		}
+		if !ok {
+			break
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if err := src.parseEvent(line); err != nil {
+			warnLog("ignoring event: %v", err)
+			continue
+		}
+
+		old := p.getState()
+		p.refreshState()
+		p.refreshPercentage()
+		// The first event gives the initial state, as at startup.
+		if first || p.getState() != old {
+			first = false
+			p.stateChange()
+		}
+		p.checkThresholds()
+	}
+
+	if readErr != nil {
+		reallyLog("reading events: %v", readErr)
+		return 1
+	}
+	maybeLog("end of events; exiting")
+	return 0
+}
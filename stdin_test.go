@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStdinEventsRunsManyHooks(t *testing.T) {
+	dir := t.TempDir()
+	hooks := filepath.Join(dir, "hooks")
+	if err := os.Mkdir(hooks, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// More hooks than the command queue holds.
+	n := commandQueueLen + 8
+	for i := 0; i < n; i++ {
+		script := fmt.Sprintf("#!/bin/sh\necho %d >>%s\n", i, filepath.Join(dir, "log"))
+		if err := os.WriteFile(filepath.Join(hooks, fmt.Sprintf("h%02d", i)), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if rc := runStdinEvents(context.Background(), actions{hookDir: hooks}, strings.NewReader("discharging 50\n")); rc != 0 {
+		t.Fatalf("runStdinEvents() = %d, want 0", rc)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(strings.Fields(string(b))); got != n {
+		t.Errorf("ran %d hooks, want %d", got, n)
+	}
+}
+
+func TestStdinEventsStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r, w := io.Pipe()
+	defer w.Close()
+	rc := make(chan int)
+	go func() { rc <- runStdinEvents(ctx, actions{}, r) }()
+
+	// Still waiting for the first event.
+	cancel()
+	select {
+	case got := <-rc:
+		if got != 1 {
+			t.Errorf("runStdinEvents() = %d, want 1", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runStdinEvents() didn't return once cancelled")
+	}
+}
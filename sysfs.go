@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Where the kernel describes power supplies, for when UPower isn't
+// available.
+const defaultSysfsRoot = "/sys/class/power_supply"
+
+// sysfsReading is what we learn from one pass over the power supplies
+// in sysfs.
+type sysfsReading struct {
+	state powerState
+	// devState is the batteries' combined status, expressed as a
+	// UPower State so that deriveState can use it.
+	devState uint32
+	// percentage is the average battery capacity. It is only
+	// meaningful when hasPercentage is true.
+	percentage    float64
+	hasPercentage bool
+	// batteries is the number of batteries present.
+	batteries int
+}
+
+// readSysfs reads the state of the power supplies under dir. We're on
+// AC power if any mains or USB supply is online. Without such a supply
+// to go by, we're on battery if any battery is discharging.
+func readSysfs(dir string) (sysfsReading, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return sysfsReading{}, err
+	}
+
+	var sawMains, online, discharging, charging bool
+	var batteries, full, withCapacity int
+	var capacity float64
+	for _, e := range entries {
+		supply := filepath.Join(dir, e.Name())
+		switch readSysfsAttr(supply, "type") {
+		case "Mains", "USB":
+			sawMains = true
+			if readSysfsAttr(supply, "online") == "1" {
+				online = true
+			}
+		case "Battery":
+			if readSysfsAttr(supply, "present") == "0" {
+				continue
+			}
+			batteries++
+			switch readSysfsAttr(supply, "status") {
+			case "Discharging":
+				discharging = true
+			case "Charging":
+				charging = true
+			case "Full":
+				full++
+			}
+			if c, err := strconv.ParseFloat(readSysfsAttr(supply, "capacity"), 64); err == nil {
+				capacity += c
+				withCapacity++
+			}
+		}
+	}
+	if !sawMains && batteries == 0 {
+		return sysfsReading{}, fmt.Errorf("no power supplies found in %s", dir)
+	}
+
+	r := sysfsReading{devState: deviceUnknown, batteries: batteries}
+	switch {
+	case charging:
+		r.devState = deviceCharging
+	case batteries > 0 && full == batteries:
+		r.devState = deviceFullyCharged
+	}
+	var src powerState = AC_POWER
+	if sawMains && !online || !sawMains && discharging {
+		src = ON_BATTERY
+	}
+	r.state = deriveState(src, r.devState)
+	if withCapacity > 0 {
+		r.percentage = capacity / float64(withCapacity)
+		r.hasPercentage = true
+	}
+	return r, nil
+}
+
+// readSysfsAttr returns the value of the named attribute of the power
+// supply at path, or "" if it can't be read.
+func readSysfsAttr(path, name string) string {
+	b, err := os.ReadFile(filepath.Join(path, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// serviceUnknown reports whether err is the bus telling us that nothing
+// provides the name we called.
+func serviceUnknown(err error) bool {
+	const unknown = "org.freedesktop.DBus.Error.ServiceUnknown"
+	var de dbus.Error
+	if errors.As(err, &de) {
+		return de.Name == unknown
+	}
+	var dep *dbus.Error
+	return errors.As(err, &dep) && dep.Name == unknown
+}
+
+// sysfsSource reads the power state from the power supplies in a
+// sysfs directory. The kernel sends no signals when they change, so
+// they are polled every --poll-interval.
+type sysfsSource struct {
+	dir string
+}
+
+func (s sysfsSource) read() (sourceState, error) {
+	r, err := readSysfs(s.dir)
+	if err != nil {
+		return sourceState{state: UNKNOWN}, err
+	}
+	return sourceState{state: r.state, devState: r.devState}, nil
+}
+
+func (s sysfsSource) percentage() (float64, error) {
+	r, err := readSysfs(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	if !r.hasPercentage {
+		return 0, errors.New("no battery capacity reported")
+	}
+	return r.percentage, nil
+}
+
+func (s sysfsSource) hasBattery() (bool, error) {
+	r, err := readSysfs(s.dir)
+	return r.batteries > 0, err
+}
+
+func (s sysfsSource) watch(ctx context.Context, c chan<- sourceState) {
+	t := time.NewTicker(*pollEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		st, err := s.read()
+		if err != nil {
+			warnLog("failed to read power supplies: %v", err)
+		}
+		select {
+		case c <- st:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
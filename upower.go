@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// The names under which UPower is normally found.
+const (
+	defaultUPowerDest  = "org.freedesktop.UPower"
+	defaultUPowerPath  = "/org/freedesktop/UPower"
+	defaultUPowerIface = "org.freedesktop.UPower"
+)
+
+const (
+	onBattery   = "OnBattery"
+	lidIsClosed = "LidIsClosed"
+
+	// The display device is UPower's aggregate of all batteries.
+	displayDevicePath = "/devices/DisplayDevice"
+	isPresent         = "IsPresent"
+	percentage        = "Percentage"
+	deviceState       = "State"
+	timeToEmpty       = "TimeToEmpty"
+	timeToFull        = "TimeToFull"
+	warningLevel      = "WarningLevel"
+)
+
+// WarningLevel values from Critical up all mean the battery is
+// critically low.
+const warningCritical uint32 = 4
+
+// Values of the UPower device State property that we distinguish.
+const (
+	deviceUnknown          uint32 = 0
+	deviceCharging         uint32 = 1
+	deviceDischarging      uint32 = 2
+	deviceEmpty            uint32 = 3
+	deviceFullyCharged     uint32 = 4
+	devicePendingDischarge uint32 = 6
+)
+
+// logind tells us about suspend and resume.
+const (
+	login1          = "org.freedesktop.login1"
+	login1Path      = "/org/freedesktop/login1"
+	login1Manager   = login1 + ".Manager"
+	prepareForSleep = login1Manager + ".PrepareForSleep"
+)
+
+// The bus itself tells us when UPower starts or stops.
+const (
+	busName          = "org.freedesktop.DBus"
+	nameOwnerChanged = busName + ".NameOwnerChanged"
+)
+
+// Bounds on the delay between system bus reconnection attempts.
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// upowerService identifies the UPower service we talk to.
+type upowerService struct {
+	dest  string          // bus name
+	path  dbus.ObjectPath // root object
+	iface string          // interface of the root object
+	// dev is the --device we follow, if any, instead of the
+	// display device and OnBattery.
+	dev dbus.ObjectPath
+}
+
+// upowerFromFlags returns the UPower service named by the --upower-*
+// flags.
+func upowerFromFlags() upowerService {
+	return upowerService{
+		dest:  *upowerDest,
+		path:  dbus.ObjectPath(*upowerPath),
+		iface: *upowerIface,
+		dev:   dbus.ObjectPath(*devicePath),
+	}
+}
+
+// device returns the interface implemented by UPower's devices.
+func (u upowerService) device() string {
+	return u.iface + ".Device"
+}
+
+// displayDevice returns the path of UPower's display device.
+func (u upowerService) displayDevice() dbus.ObjectPath {
+	return u.path + displayDevicePath
+}
+
+// watched returns the path of the device whose state and percentage we
+// follow: the --device, if set, otherwise the display device.
+func (u upowerService) watched() dbus.ObjectPath {
+	if u.dev != "" {
+		return u.dev
+	}
+	return u.displayDevice()
+}
+
+// readOnBattery asks UPower whether we're running on battery,
+// returning ON_BATTERY or AC_POWER.
+func (u upowerService) readOnBattery(bus busConn) (powerState, error) {
+	obj := bus.Object(u.dest, u.path)
+	ps, err := obj.GetProperty(u.iface + "." + onBattery)
+	if err != nil {
+		return UNKNOWN, err
+	}
+	v, ok := ps.Value().(bool)
+	if !ok {
+		return UNKNOWN, fmt.Errorf("unexpected %s type %q", onBattery, ps.Signature())
+	}
+	if v {
+		return ON_BATTERY, nil
+	}
+	return AC_POWER, nil
+}
+
+// readLidClosed asks UPower whether the lid is closed.
+func (u upowerService) readLidClosed(bus busConn) (bool, error) {
+	v, err := bus.Object(u.dest, u.path).GetProperty(u.iface + "." + lidIsClosed)
+	if err != nil {
+		return false, err
+	}
+	closed, ok := v.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("unexpected %s type %q", lidIsClosed, v.Signature())
+	}
+	return closed, nil
+}
+
+// readDeviceState returns the UPower State of the watched device.
+func (u upowerService) readDeviceState(bus busConn) (uint32, error) {
+	v, err := bus.Object(u.dest, u.watched()).GetProperty(u.device() + "." + deviceState)
+	if err != nil {
+		return deviceUnknown, err
+	}
+	ds, ok := v.Value().(uint32)
+	if !ok {
+		return deviceUnknown, fmt.Errorf("unexpected %s type %q", deviceState, v.Signature())
+	}
+	return ds, nil
+}
+
+// readWarningLevel returns the UPower WarningLevel of the watched
+// device.
+func (u upowerService) readWarningLevel(bus busConn) (uint32, error) {
+	v, err := bus.Object(u.dest, u.watched()).GetProperty(u.device() + "." + warningLevel)
+	if err != nil {
+		return 0, err
+	}
+	wl, ok := v.Value().(uint32)
+	if !ok {
+		return 0, fmt.Errorf("unexpected %s type %q", warningLevel, v.Signature())
+	}
+	return wl, nil
+}
+
+// stateFor returns the power state given src, ON_BATTERY or AC_POWER
+// according to UPower's OnBattery, and ds, the State of the watched
+// device. When following a --device, its State alone decides.
+func (u upowerService) stateFor(src powerState, ds uint32) powerState {
+	if u.dev != "" {
+		switch ds {
+		case deviceUnknown:
+			src = UNKNOWN
+		case deviceDischarging, deviceEmpty, devicePendingDischarge:
+			src = ON_BATTERY
+		default:
+			src = AC_POWER
+		}
+	}
+	return deriveState(src, ds)
+}
+
+// deriveState refines ps, one of the simple states, using the display
+// device's State, unless --simple-states is set.
+func deriveState(ps powerState, ds uint32) powerState {
+	if *simple {
+		return ps
+	}
+	switch {
+	case ps == ON_BATTERY:
+		return DISCHARGING
+	case ps == AC_POWER && ds == deviceCharging:
+		return CHARGING
+	case ps == AC_POWER && ds == deviceFullyCharged:
+		return FULL
+	}
+	return ps
+}
+
+// readPercentage returns the charge level of the watched device.
+func (u upowerService) readPercentage(bus busConn) (float64, error) {
+	dev := bus.Object(u.dest, u.watched())
+
+	// On systems without a battery the display device still exists
+	// but reports itself as not present, with a meaningless
+	// percentage.
+	present, err := dev.GetProperty(u.device() + "." + isPresent)
+	if err != nil {
+		return 0, err
+	}
+	if v, ok := present.Value().(bool); !ok || !v {
+		return 0, errors.New("no battery present")
+	}
+
+	pct, err := dev.GetProperty(u.device() + "." + percentage)
+	if err != nil {
+		return 0, err
+	}
+	v, ok := pct.Value().(float64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected %s type %q", percentage, pct.Signature())
+	}
+	return v, nil
+}
+
+// readTime returns the watched device's estimate, in seconds, held in
+// prop, one of TimeToEmpty or TimeToFull. UPower reports 0 while it is
+// still estimating, which we return as -1.
+func (u upowerService) readTime(bus busConn, prop string) (int64, error) {
+	v, err := bus.Object(u.dest, u.watched()).GetProperty(u.device() + "." + prop)
+	if err != nil {
+		return -1, err
+	}
+	secs, ok := v.Value().(int64)
+	if !ok {
+		return -1, fmt.Errorf("unexpected %s type %q", prop, v.Signature())
+	}
+	if secs == 0 {
+		return -1, nil
+	}
+	return secs, nil
+}
+
+// subscribe asks the bus to deliver UPower starting and stopping, and
+// logind sleep notifications, to us, along with UPower property changes
+// if props is set.
+func (u upowerService) subscribe(bus busConn, props bool) error {
+	if props {
+		if err := u.subscribeProps(bus); err != nil {
+			return err
+		}
+	}
+	if err := bus.AddMatchSignal(dbus.WithMatchInterface(busName), dbus.WithMatchMember("NameOwnerChanged"), dbus.WithMatchSender(busName), dbus.WithMatchArg(0, u.dest)); err != nil {
+		return fmt.Errorf("couldn't setup UPower owner listener: %v", err)
+	}
+	if err := bus.AddMatchSignal(dbus.WithMatchObjectPath(login1Path), dbus.WithMatchInterface(login1Manager), dbus.WithMatchMember("PrepareForSleep"), dbus.WithMatchSender(login1)); err != nil {
+		return fmt.Errorf("couldn't setup sleep listener: %v", err)
+	}
+	if trackBatteries() {
+		if err := bus.AddMatchSignal(dbus.WithMatchObjectPath(u.path), dbus.WithMatchInterface(u.iface), dbus.WithMatchSender(u.dest)); err != nil {
+			return fmt.Errorf("couldn't setup device listener: %v", err)
+		}
+	}
+	return nil
+}
+
+// subscribeProps asks the bus to deliver changes to the properties of
+// UPower and the device we watch.
+func (u upowerService) subscribeProps(bus busConn) error {
+	for _, path := range []dbus.ObjectPath{u.path, u.watched()} {
+		if err := bus.AddMatchSignal(dbus.WithMatchObjectPath(path), dbus.WithMatchInterface("org.freedesktop.DBus.Properties"), dbus.WithMatchSender(u.dest)); err != nil {
+			return fmt.Errorf("couldn't setup signal listener for %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// waitFor waits up to timeout for UPower to appear on bus, as early in
+// boot it may not have started yet. It returns at once if UPower is
+// already running, or can be started on demand.
+func (u upowerService) waitFor(bus busConn, timeout time.Duration) error {
+	c := make(chan *dbus.Signal, 10)
+	bus.Signal(c)
+	defer bus.RemoveSignal(c)
+	match := []dbus.MatchOption{dbus.WithMatchInterface(busName), dbus.WithMatchMember("NameOwnerChanged"), dbus.WithMatchSender(busName), dbus.WithMatchArg(0, u.dest)}
+	if err := bus.AddMatchSignal(match...); err != nil {
+		return fmt.Errorf("couldn't setup UPower owner listener: %v", err)
+	}
+	defer bus.RemoveMatchSignal(match...)
+
+	// Only look once listening, so that UPower can't appear unseen
+	// in between.
+	if _, err := u.readOnBattery(bus); err == nil {
+		return nil
+	}
+	maybeLog("waiting up to %v for %s to appear", timeout, u.dest)
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case sig := <-c:
+			var name, oldOwner, newOwner string
+			if sig.Name != nameOwnerChanged || dbus.Store(sig.Body, &name, &oldOwner, &newOwner) != nil {
+				continue
+			}
+			if name == u.dest && newOwner != "" {
+				maybeLog("%s is now on the bus", name)
+				return nil
+			}
+		case <-t.C:
+			return fmt.Errorf("%s didn't appear on the system bus within %v; is UPower installed and running?", u.dest, timeout)
+		}
+	}
+}
+
+// reconnect replaces a lost system bus connection, retrying with
+// exponential backoff until it succeeds. Any state change missed while
+// disconnected is acted upon. It returns false if we were asked to
+// quit while waiting.
+func (p *powermon) reconnect() bool {
+	delay := minReconnectDelay
+	for attempt := 1; ; attempt++ {
+		maybeLog("reconnecting to system bus in %v (attempt %d)", delay, attempt)
+		// systemd's notify socket doesn't need the bus, so keep
+		// telling it we're alive, however long the bus is gone.
+		wait := time.NewTimer(delay)
+	waiting:
+		for {
+			select {
+			case <-wait.C:
+				break waiting
+			case <-p.watchdogC:
+				feedWatchdog()
+			case <-p.ctx.Done():
+				wait.Stop()
+				return false
+			}
+		}
+
+		bus, err := p.redial()
+		if err == nil {
+			// Listen before subscribing and resyncing, as at
+			// startup, so that no signal is lost in between.
+			c := listen(bus)
+			if err = p.subscribe(bus); err == nil {
+				p.sysBus.Close()
+				p.sysBus = bus
+				p.sigC = c
+				break
+			}
+			bus.Close()
+		}
+		warnLog("system bus reconnect failed: %v", err)
+
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+
+	maybeLog("reconnected to system bus")
+	p.resync()
+	return true
+}
+
+// ownerChanged handles NameOwnerChanged for UPower's bus name. If
+// UPower wasn't running when we started, or restarts, we re-read
+// everything once it is back.
+func (p *powermon) ownerChanged(sig *dbus.Signal) {
+	var name, oldOwner, newOwner string
+	if err := dbus.Store(sig.Body, &name, &oldOwner, &newOwner); err != nil || name != p.upower.dest {
+		return
+	}
+	if newOwner == "" {
+		warnLog("%s has left the bus", name)
+		p.upowerGone = true
+		return
+	}
+	// Our match rules name UPower by its well known name, so they
+	// still apply to the new instance; only its state is new.
+	if p.upowerGone || oldOwner != "" {
+		maybeLog("%s restarted; re-reading power state", name)
+	} else {
+		maybeLog("%s is now on the bus; re-reading power state", name)
+	}
+	p.upowerGone = false
+	if !p.onUPower() && *backend == "auto" {
+		p.switchToUPower()
+	}
+	p.resync()
+}
+
+// switchToUPower makes UPower our source in place of sysfs, which auto
+// only falls back to because UPower wasn't running at startup.
+func (p *powermon) switchToUPower() {
+	maybeLog("reading the power state from %s instead of %s", p.upower.dest, *sysfsRoot)
+	if p.stopWatch != nil {
+		p.stopWatch()
+	}
+	p.source = upowerSource{p.upower, &p.sysBus}
+	if err := p.upower.subscribeProps(p.sysBus); err != nil {
+		warnLog("%v", err)
+	}
+	if closed, err := p.upower.readLidClosed(p.sysBus); err != nil {
+		maybeLog("failed to get lid state: %v", err)
+	} else {
+		p.lidClosed = closed
+	}
+}
+
+// resync re-reads everything we track from UPower, for use when we may
+// have missed signals, and acts on any state change.
+func (p *powermon) resync() {
+	p.refreshPercentage()
+	if trackBatteries() {
+		p.refreshBatteries()
+	}
+	old := p.getState()
+	if err := p.refreshState(); err != nil {
+		warnLog("failed to get battery state: %v", err)
+	}
+	if p.getState() != old {
+		p.stateChange()
+	}
+}
+
+// upowerSource reads the power state from UPower over the system bus
+// connection that bus points to.
+type upowerSource struct {
+	upowerService
+	bus *busConn
+}
+
+func (s upowerSource) read() (sourceState, error) {
+	ds, err := s.readDeviceState(*s.bus)
+	if err != nil {
+		// Not fatal; there may be no battery.
+		debugLog("failed to get device state: %v", err)
+	}
+	// Likewise not fatal.
+	wl, _ := s.readWarningLevel(*s.bus)
+
+	if s.dev != "" {
+		return sourceState{state: s.stateFor(UNKNOWN, ds), devState: ds, warningLevel: wl}, err
+	}
+	src, err := s.readOnBattery(*s.bus)
+	return sourceState{state: s.stateFor(src, ds), devState: ds, warningLevel: wl}, err
+}
+
+func (s upowerSource) percentage() (float64, error) {
+	return s.readPercentage(*s.bus)
+}
+
+func (s upowerSource) hasBattery() (bool, error) {
+	bats, err := s.enumerateBatteries(*s.bus)
+	return len(bats) > 0, err
+}
+
+// watch returns at once: UPower's changes arrive as signals on the
+// system bus, which run() handles itself.
+func (s upowerSource) watch(ctx context.Context, c chan<- sourceState) {}
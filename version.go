@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is set at build time, e.g. with
+// -ldflags "-X main.version=v1.2.3".
+var version string
+
+// versionString describes this build. Without a version set at build
+// time, it falls back to the module version recorded by go install.
+func versionString() string {
+	v := version
+	if v == "" {
+		v = "(devel)"
+		if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+			v = bi.Main.Version
+		}
+	}
+	return fmt.Sprintf("powermon %s (%s)", v, runtime.Version())
+}